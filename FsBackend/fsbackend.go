@@ -2,17 +2,26 @@ package FsBackend
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// TempPrefix marks files which are still being written. They are renamed into
+// place once complete, so readers never see partial tiles.
+const TempPrefix = ".prioritile-tmp-"
+
 type FsBackend struct {
 	BasePath string
+	// Sync flushes every file to disk before it is renamed into place.
+	Sync bool
 }
 
-func (b *FsBackend) GetFile(filename string) ([]byte, error) {
+func (b *FsBackend) GetFile(ctx context.Context, filename string) ([]byte, error) {
 	f, err := os.Open(filepath.Join(b.BasePath, filename))
 	defer f.Close()
 	if err != nil {
@@ -26,20 +35,103 @@ func (b *FsBackend) GetFile(filename string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (b *FsBackend) PutFile(filename string, content *bytes.Buffer) error {
-	return ioutil.WriteFile(filepath.Join(b.BasePath, filename), content.Bytes(), 0755)
+func (b *FsBackend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
+	path := filepath.Join(b.BasePath, filename)
+	f, err := ioutil.TempFile(filepath.Dir(path), TempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content.Bytes()); err == nil && b.Sync {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err == nil && b.Sync {
+		// The rename itself is only durable once the directory is flushed
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
 
-func (b *FsBackend) FileExists(filename string) bool {
+// syncDir flushes the entries of a directory to disk.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CleanTempFiles removes the temporary files left behind by interrupted
+// writes and returns how many there were.
+func (b *FsBackend) CleanTempFiles() (int, error) {
+	removed := 0
+	err := filepath.Walk(b.BasePath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), TempPrefix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+func (b *FsBackend) FileExists(ctx context.Context, filename string) bool {
 	_, err := os.Stat(filepath.Join(b.BasePath, filename))
 	return err == nil
 }
 
-func (b *FsBackend) MkdirAll(dirname string) error {
-	return os.MkdirAll(filepath.Join(b.BasePath, dirname), 0755)
+// GetFileVersion identifies the content of a file by its mtime and size.
+func (b *FsBackend) GetFileVersion(ctx context.Context, filename string) (string, error) {
+	info, err := os.Stat(filepath.Join(b.BasePath, filename))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+func (b *FsBackend) MkdirAll(ctx context.Context, dirname string) error {
+	if err := os.MkdirAll(filepath.Join(b.BasePath, dirname), 0755); err != nil || !b.Sync {
+		return err
+	}
+	// New directories are only durable once their parents are flushed
+	dir := b.BasePath
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	for _, part := range strings.Split(filepath.ToSlash(dirname), "/") {
+		if part == "" {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (b *FsBackend) GetDirectories(dirname string) ([]string, error) {
+func (b *FsBackend) GetDirectories(ctx context.Context, dirname string) ([]string, error) {
 	files, err := ioutil.ReadDir(filepath.Join(b.BasePath, dirname))
 	if err != nil {
 		return nil, err
@@ -54,7 +146,7 @@ func (b *FsBackend) GetDirectories(dirname string) ([]string, error) {
 	return results, nil
 }
 
-func (b *FsBackend) GetFiles(dirname string) ([]string, error) {
+func (b *FsBackend) GetFiles(ctx context.Context, dirname string) ([]string, error) {
 	files, err := ioutil.ReadDir(filepath.Join(b.BasePath, dirname))
 	if err != nil {
 		return nil, err
@@ -62,23 +154,31 @@ func (b *FsBackend) GetFiles(dirname string) ([]string, error) {
 
 	var results []string
 	for idx, file := range files {
-		if !file.IsDir() {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), TempPrefix) {
 			results = append(results, files[idx].Name())
 		}
 	}
 	return results, nil
 }
 
-func (b *FsBackend) GetFilesRecursive(dirname string) ([]string, error) {
+func (b *FsBackend) GetFilesRecursive(ctx context.Context, dirname string) ([]string, error) {
 	var results []string
 
-	err := filepath.Walk(filepath.Join(b.BasePath, dirname), func(path string, info fs.FileInfo, err error) error {
+	root := filepath.Join(b.BasePath, dirname)
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			info.Name()
-			results = append(results, path)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), TempPrefix) {
+			// Paths are relative to the listed directory, just like on S3
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			results = append(results, filepath.ToSlash(rel))
 		}
 		return nil
 	})
@@ -0,0 +1,44 @@
+package FsBackend
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutFile(t *testing.T) {
+	ctx := context.Background()
+	b := &FsBackend{BasePath: t.TempDir(), Sync: true}
+	require.NoError(t, b.MkdirAll(ctx, "1/0/"))
+	require.NoError(t, b.PutFile(ctx, "1/0/0.png", bytes.NewBufferString("old")))
+	require.NoError(t, b.PutFile(ctx, "1/0/0.png", bytes.NewBufferString("new")))
+
+	content, err := b.GetFile(ctx, "1/0/0.png")
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+	info, err := os.Stat(filepath.Join(b.BasePath, "1/0/0.png"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// Leftovers of a crashed run
+	require.NoError(t, ioutil.WriteFile(filepath.Join(b.BasePath, "1/0/"+TempPrefix+"123"), []byte("partial"), 0644))
+	files, err := b.GetFiles(ctx, "1/0/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.png"}, files)
+	files, err = b.GetFilesRecursive(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/0/0.png"}, files)
+
+	removed, err := b.CleanTempFiles()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	entries, err := ioutil.ReadDir(filepath.Join(b.BasePath, "1/0/"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
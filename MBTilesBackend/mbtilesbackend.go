@@ -0,0 +1,326 @@
+package MBTilesBackend
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/v4lli/prioritile/TileMath"
+)
+
+// MBTilesBackend exposes the tiles of an MBTiles (SQLite) file through the
+// usual {z}/{x}/{y}.<ext> paths. MBTiles stores rows in TMS order, so the y
+// coordinate is flipped on every access.
+type MBTilesBackend struct {
+	DB   *sql.DB
+	Path string
+	// Format is the file extension used for tile paths, taken from the
+	// metadata table (png if unset).
+	Format string
+	// Deduplicated is set if tiles is a view over the map and images tables.
+	Deduplicated bool
+
+	mu      sync.Mutex
+	written map[string]bool // formats written through PutFile
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS metadata (name text, value text);
+CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
+CREATE TABLE IF NOT EXISTS tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+func NewMBTilesBackend(path string, create bool) (*MBTilesBackend, error) {
+	path = strings.TrimPrefix(path, "mbtiles://")
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) && !create {
+		return nil, err
+	}
+
+	mode := "rwc"
+	if !create {
+		mode = "rw"
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=%s&_busy_timeout=5000", path, mode))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer anyway; serializing all access through
+	// one connection avoids SQLITE_BUSY errors between the workers.
+	db.SetMaxOpenConns(1)
+
+	b := &MBTilesBackend{
+		DB:      db,
+		Path:    path,
+		Format:  "png",
+		written: map[string]bool{},
+	}
+
+	var kind string
+	err = db.QueryRow("SELECT type FROM sqlite_master WHERE name = 'tiles'").Scan(&kind)
+	if err == sql.ErrNoRows {
+		if _, err := db.Exec(schema); err != nil {
+			db.Close()
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if err := b.setMetadata("name", name); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s is not a valid mbtiles file: %w", path, err)
+	}
+	b.Deduplicated = kind == "view"
+
+	var format string
+	err = db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format)
+	if err == nil && format != "" {
+		b.Format = format
+	} else if err != nil && err != sql.ErrNoRows {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// parsePath splits "z/x/y.ext" into XYZ coordinates and the extension.
+func parsePath(filename string) (int, int, int, string, error) {
+	parts := strings.Split(strings.TrimPrefix(filename, "/"), "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, "", fmt.Errorf("invalid tile path %s, expected format {z}/{x}/{y}.<ext>", filename)
+	}
+	fileParts := strings.SplitN(parts[2], ".", 2)
+	if len(fileParts) != 2 {
+		return 0, 0, 0, "", fmt.Errorf("invalid tile path %s, expected format {z}/{x}/{y}.<ext>", filename)
+	}
+	z, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	x, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	y, err := strconv.Atoi(fileParts[0])
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	return z, x, y, fileParts[1], nil
+}
+
+// flipY converts between XYZ and TMS row numbering (the operation is its own
+// inverse).
+func flipY(z int, y int) int {
+	return (1 << uint(z)) - 1 - y
+}
+
+func (b *MBTilesBackend) GetFile(ctx context.Context, filename string) ([]byte, error) {
+	z, x, y, _, err := parsePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = b.DB.QueryRowContext(ctx, "SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		z, x, flipY(z, y)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+	}
+	return data, err
+}
+
+func (b *MBTilesBackend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
+	z, x, y, ext, err := parsePath(filename)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.written[ext] = true
+	b.mu.Unlock()
+
+	if !b.Deduplicated {
+		_, err = b.DB.ExecContext(ctx, "INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)",
+			z, x, flipY(z, y), content.Bytes())
+		return err
+	}
+
+	sum := md5.Sum(content.Bytes())
+	id := hex.EncodeToString(sum[:])
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO images (tile_id, tile_data) SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM images WHERE tile_id = ?)",
+		id, content.Bytes(), id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?)",
+		z, x, flipY(z, y), id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *MBTilesBackend) FileExists(ctx context.Context, filename string) bool {
+	z, x, y, _, err := parsePath(filename)
+	if err != nil {
+		return false
+	}
+	var one int
+	err = b.DB.QueryRowContext(ctx, "SELECT 1 FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		z, x, flipY(z, y)).Scan(&one)
+	return err == nil
+}
+
+func (b *MBTilesBackend) MkdirAll(ctx context.Context, dirname string) error {
+	// There are no directories in an mbtiles file
+	return nil
+}
+
+func (b *MBTilesBackend) GetDirectories(ctx context.Context, dirname string) ([]string, error) {
+	z, x, err := TileMath.ParseDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	var rows *sql.Rows
+	if z < 0 {
+		rows, err = b.DB.QueryContext(ctx, "SELECT DISTINCT zoom_level FROM tiles ORDER BY zoom_level")
+	} else if x < 0 {
+		rows, err = b.DB.QueryContext(ctx, "SELECT DISTINCT tile_column FROM tiles WHERE zoom_level = ? ORDER BY tile_column", z)
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []string
+	for rows.Next() {
+		var n int
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		results = append(results, strconv.Itoa(n))
+	}
+	return results, rows.Err()
+}
+
+func (b *MBTilesBackend) GetFiles(ctx context.Context, dirname string) ([]string, error) {
+	z, x, err := TileMath.ParseDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if z < 0 || x < 0 {
+		// Tiles only ever live in {z}/{x}/
+		return nil, nil
+	}
+	return b.listTiles(ctx, dirname, "WHERE zoom_level = ? AND tile_column = ?", z, x)
+}
+
+func (b *MBTilesBackend) GetFilesRecursive(ctx context.Context, dirname string) ([]string, error) {
+	z, x, err := TileMath.ParseDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if z < 0 {
+		return b.listTiles(ctx, dirname, "")
+	} else if x < 0 {
+		return b.listTiles(ctx, dirname, "WHERE zoom_level = ?", z)
+	}
+	return b.listTiles(ctx, dirname, "WHERE zoom_level = ? AND tile_column = ?", z, x)
+}
+
+// listTiles returns the paths of all tiles matched by where, relative to
+// dirname.
+func (b *MBTilesBackend) listTiles(ctx context.Context, dirname string, where string, args ...interface{}) ([]string, error) {
+	// Descending TMS rows are ascending XYZ rows
+	rows, err := b.DB.QueryContext(ctx, "SELECT zoom_level, tile_column, tile_row FROM tiles "+where+
+		" ORDER BY zoom_level, tile_column, tile_row DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefix := strings.TrimPrefix(dirname, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var results []string
+	for rows.Next() {
+		var z, x, row int
+		if err := rows.Scan(&z, &x, &row); err != nil {
+			return nil, err
+		}
+		path := fmt.Sprintf("%d/%d/%d.%s", z, x, flipY(z, row), b.Format)
+		results = append(results, strings.TrimPrefix(path, prefix))
+	}
+	return results, rows.Err()
+}
+
+func (b *MBTilesBackend) setMetadata(name string, value string) error {
+	_, err := b.DB.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+// Finalize brings the metadata table (minzoom, maxzoom, bounds, format) up to
+// date with the tiles which are now stored in the file.
+func (b *MBTilesBackend) Finalize() error {
+	var minZ, maxZ sql.NullInt64
+	err := b.DB.QueryRow("SELECT MIN(zoom_level), MAX(zoom_level) FROM tiles").Scan(&minZ, &maxZ)
+	if err != nil {
+		return err
+	}
+	if !minZ.Valid {
+		// empty tileset, nothing to describe
+		return nil
+	}
+
+	z := int(maxZ.Int64)
+	var minX, maxX, minRow, maxRow int
+	err = b.DB.QueryRow("SELECT MIN(tile_column), MAX(tile_column), MIN(tile_row), MAX(tile_row) FROM tiles WHERE zoom_level = ?",
+		z).Scan(&minX, &maxX, &minRow, &maxRow)
+	if err != nil {
+		return err
+	}
+	// The highest TMS row is the northernmost one
+	bounds := fmt.Sprintf("%f,%f,%f,%f",
+		TileMath.Tile2Lon(minX, z), TileMath.Tile2Lat(flipY(z, minRow)+1, z),
+		TileMath.Tile2Lon(maxX+1, z), TileMath.Tile2Lat(flipY(z, maxRow), z))
+
+	metadata := map[string]string{
+		"minzoom": strconv.FormatInt(minZ.Int64, 10),
+		"maxzoom": strconv.FormatInt(maxZ.Int64, 10),
+		"bounds":  bounds,
+	}
+	b.mu.Lock()
+	if len(b.written) == 1 {
+		for format := range b.written {
+			metadata["format"] = format
+		}
+	}
+	b.mu.Unlock()
+
+	for name, value := range metadata {
+		if err := b.setMetadata(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
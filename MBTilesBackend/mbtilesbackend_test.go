@@ -0,0 +1,112 @@
+package MBTilesBackend
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metadata(t *testing.T, b *MBTilesBackend, name string) string {
+	var value string
+	require.NoError(t, b.DB.QueryRow("SELECT value FROM metadata WHERE name = ?", name).Scan(&value))
+	return value
+}
+
+func TestRoundtrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.mbtiles")
+	b, err := NewMBTilesBackend(path, true)
+	require.NoError(t, err)
+	for _, tile := range []string{"2/1/0.webp", "2/1/3.webp", "2/2/1.webp", "1/0/0.webp"} {
+		require.NoError(t, b.PutFile(ctx, tile, bytes.NewBufferString(tile)))
+	}
+	require.NoError(t, b.Finalize())
+	require.NoError(t, b.DB.Close())
+
+	b, err = NewMBTilesBackend(path, false)
+	require.NoError(t, err)
+	defer b.DB.Close()
+	assert.False(t, b.Deduplicated)
+	assert.Equal(t, "webp", b.Format)
+	assert.Equal(t, "test", metadata(t, b, "name"))
+	assert.Equal(t, "1", metadata(t, b, "minzoom"))
+	assert.Equal(t, "2", metadata(t, b, "maxzoom"))
+	// The tiles of zoom level 2 span x 1-2 and y 0-3
+	assert.Equal(t, "-90.000000,-85.051129,90.000000,85.051129", metadata(t, b, "bounds"))
+
+	// Rows are stored in TMS order
+	var row int
+	require.NoError(t, b.DB.QueryRow("SELECT tile_row FROM tiles WHERE zoom_level = 2 AND tile_column = 2").Scan(&row))
+	assert.Equal(t, 2, row)
+	data, err := b.GetFile(ctx, "2/2/1.webp")
+	require.NoError(t, err)
+	assert.Equal(t, "2/2/1.webp", string(data))
+	assert.True(t, b.FileExists(ctx, "2/1/3.webp"))
+	assert.False(t, b.FileExists(ctx, "2/1/1.webp"))
+	_, err = b.GetFile(ctx, "2/1/1.webp")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	dirs, err := b.GetDirectories(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, dirs)
+	dirs, err = b.GetDirectories(ctx, "2/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, dirs)
+	files, err := b.GetFiles(ctx, "2/1/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.webp", "3.webp"}, files)
+	files, err = b.GetFilesRecursive(ctx, "2/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/0.webp", "1/3.webp", "2/1.webp"}, files)
+	files, err = b.GetFilesRecursive(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+}
+
+func TestDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup.mbtiles")
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+CREATE TABLE metadata (name text, value text);
+CREATE UNIQUE INDEX name ON metadata (name);
+CREATE TABLE map (zoom_level integer, tile_column integer, tile_row integer, tile_id text);
+CREATE UNIQUE INDEX map_index ON map (zoom_level, tile_column, tile_row);
+CREATE TABLE images (tile_data blob, tile_id text);
+CREATE UNIQUE INDEX images_id ON images (tile_id);
+CREATE VIEW tiles AS SELECT map.zoom_level AS zoom_level, map.tile_column AS tile_column, map.tile_row AS tile_row,
+	images.tile_data AS tile_data FROM map JOIN images ON images.tile_id = map.tile_id;
+`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	b, err := NewMBTilesBackend(path, false)
+	require.NoError(t, err)
+	defer b.DB.Close()
+	require.True(t, b.Deduplicated)
+	require.NoError(t, b.PutFile(ctx, "1/0/0.png", bytes.NewBufferString("same")))
+	require.NoError(t, b.PutFile(ctx, "1/1/0.png", bytes.NewBufferString("same")))
+	require.NoError(t, b.PutFile(ctx, "1/1/1.png", bytes.NewBufferString("other")))
+	// Overwriting a tile replaces its mapping
+	require.NoError(t, b.PutFile(ctx, "1/1/1.png", bytes.NewBufferString("same")))
+
+	var images, mapped int
+	require.NoError(t, b.DB.QueryRow("SELECT COUNT(*) FROM images").Scan(&images))
+	require.NoError(t, b.DB.QueryRow("SELECT COUNT(*) FROM map").Scan(&mapped))
+	assert.Equal(t, 2, images)
+	assert.Equal(t, 3, mapped)
+	data, err := b.GetFile(ctx, "1/1/1.png")
+	require.NoError(t, err)
+	assert.Equal(t, "same", string(data))
+	files, err := b.GetFiles(ctx, "1/1/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.png", "1.png"}, files)
+}
@@ -0,0 +1,398 @@
+package PMTilesBackend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// This file implements the parts of the PMTiles v3 specification needed to
+// read and write raster archives, see
+// https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+
+const (
+	headerLength = 127
+	// The header and the root directory have to fit into the first 16 KiB
+	maxRootLength = 16384 - headerLength
+)
+
+const (
+	compressionUnknown = 0
+	compressionNone    = 1
+	compressionGzip    = 2
+)
+
+const (
+	tileTypeUnknown = 0
+	tileTypeMvt     = 1
+	tileTypePng     = 2
+	tileTypeJpeg    = 3
+	tileTypeWebp    = 4
+	tileTypeAvif    = 5
+)
+
+type header struct {
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafOffset          uint64
+	LeafLength          uint64
+	DataOffset          uint64
+	DataLength          uint64
+	AddressedTiles      uint64
+	TileEntries         uint64
+	TileContents        uint64
+	Clustered           bool
+	InternalCompression uint8
+	TileCompression     uint8
+	TileType            uint8
+	MinZoom             uint8
+	MaxZoom             uint8
+	MinLonE7            int32
+	MinLatE7            int32
+	MaxLonE7            int32
+	MaxLatE7            int32
+	CenterZoom          uint8
+	CenterLonE7         int32
+	CenterLatE7         int32
+}
+
+// entry is a directory entry. Entries with a RunLength of 0 point to a leaf
+// directory instead of tile data.
+type entry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+func serializeHeader(h header) []byte {
+	b := make([]byte, headerLength)
+	copy(b[0:7], "PMTiles")
+	b[7] = 3
+	binary.LittleEndian.PutUint64(b[8:], h.RootOffset)
+	binary.LittleEndian.PutUint64(b[16:], h.RootLength)
+	binary.LittleEndian.PutUint64(b[24:], h.MetadataOffset)
+	binary.LittleEndian.PutUint64(b[32:], h.MetadataLength)
+	binary.LittleEndian.PutUint64(b[40:], h.LeafOffset)
+	binary.LittleEndian.PutUint64(b[48:], h.LeafLength)
+	binary.LittleEndian.PutUint64(b[56:], h.DataOffset)
+	binary.LittleEndian.PutUint64(b[64:], h.DataLength)
+	binary.LittleEndian.PutUint64(b[72:], h.AddressedTiles)
+	binary.LittleEndian.PutUint64(b[80:], h.TileEntries)
+	binary.LittleEndian.PutUint64(b[88:], h.TileContents)
+	if h.Clustered {
+		b[96] = 1
+	}
+	b[97] = h.InternalCompression
+	b[98] = h.TileCompression
+	b[99] = h.TileType
+	b[100] = h.MinZoom
+	b[101] = h.MaxZoom
+	binary.LittleEndian.PutUint32(b[102:], uint32(h.MinLonE7))
+	binary.LittleEndian.PutUint32(b[106:], uint32(h.MinLatE7))
+	binary.LittleEndian.PutUint32(b[110:], uint32(h.MaxLonE7))
+	binary.LittleEndian.PutUint32(b[114:], uint32(h.MaxLatE7))
+	b[118] = h.CenterZoom
+	binary.LittleEndian.PutUint32(b[119:], uint32(h.CenterLonE7))
+	binary.LittleEndian.PutUint32(b[123:], uint32(h.CenterLatE7))
+	return b
+}
+
+func deserializeHeader(b []byte) (header, error) {
+	if len(b) < headerLength || string(b[0:7]) != "PMTiles" {
+		return header{}, fmt.Errorf("not a pmtiles archive")
+	}
+	if b[7] != 3 {
+		return header{}, fmt.Errorf("unsupported pmtiles version %d", b[7])
+	}
+	return header{
+		RootOffset:          binary.LittleEndian.Uint64(b[8:]),
+		RootLength:          binary.LittleEndian.Uint64(b[16:]),
+		MetadataOffset:      binary.LittleEndian.Uint64(b[24:]),
+		MetadataLength:      binary.LittleEndian.Uint64(b[32:]),
+		LeafOffset:          binary.LittleEndian.Uint64(b[40:]),
+		LeafLength:          binary.LittleEndian.Uint64(b[48:]),
+		DataOffset:          binary.LittleEndian.Uint64(b[56:]),
+		DataLength:          binary.LittleEndian.Uint64(b[64:]),
+		AddressedTiles:      binary.LittleEndian.Uint64(b[72:]),
+		TileEntries:         binary.LittleEndian.Uint64(b[80:]),
+		TileContents:        binary.LittleEndian.Uint64(b[88:]),
+		Clustered:           b[96] == 1,
+		InternalCompression: b[97],
+		TileCompression:     b[98],
+		TileType:            b[99],
+		MinZoom:             b[100],
+		MaxZoom:             b[101],
+		MinLonE7:            int32(binary.LittleEndian.Uint32(b[102:])),
+		MinLatE7:            int32(binary.LittleEndian.Uint32(b[106:])),
+		MaxLonE7:            int32(binary.LittleEndian.Uint32(b[110:])),
+		MaxLatE7:            int32(binary.LittleEndian.Uint32(b[114:])),
+		CenterZoom:          b[118],
+		CenterLonE7:         int32(binary.LittleEndian.Uint32(b[119:])),
+		CenterLatE7:         int32(binary.LittleEndian.Uint32(b[123:])),
+	}, nil
+}
+
+func serializeEntries(entries []entry) []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(len(entries)))
+	var last uint64
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.TileID-last)
+		last = e.TileID
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.Length))
+	}
+	for i, e := range entries {
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			b = binary.AppendUvarint(b, 0)
+		} else {
+			b = binary.AppendUvarint(b, e.Offset+1)
+		}
+	}
+	return b
+}
+
+func deserializeEntries(b []byte) ([]entry, error) {
+	r := bytes.NewReader(b)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entry, n)
+	var last uint64
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		last += v
+		entries[i].TileID = last
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].RunLength = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Length = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = v - 1
+		}
+	}
+	return entries, nil
+}
+
+func compress(b []byte, compression uint8) ([]byte, error) {
+	switch compression {
+	case compressionNone:
+		return b, nil
+	case compressionGzip:
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %d", compression)
+}
+
+func decompress(b []byte, compression uint8) ([]byte, error) {
+	switch compression {
+	case compressionNone, compressionUnknown:
+		return b, nil
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unsupported compression %d", compression)
+}
+
+// findTile returns the entry covering tileID: either the tile itself or the
+// leaf directory which has to be searched next.
+func findTile(entries []entry, tileID uint64) (entry, bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].TileID > tileID }) - 1
+	if i < 0 {
+		return entry{}, false
+	}
+	e := entries[i]
+	if e.RunLength == 0 || tileID < e.TileID+uint64(e.RunLength) {
+		return e, true
+	}
+	return entry{}, false
+}
+
+// buildDirectories serializes entries into a root directory that fits into
+// the first 16 KiB of the archive, spilling into leaf directories if needed.
+func buildDirectories(entries []entry, compression uint8) ([]byte, []byte, error) {
+	root, err := compress(serializeEntries(entries), compression)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(root) <= maxRootLength {
+		return root, nil, nil
+	}
+
+	leafSize := float64(len(entries)) / 3500
+	if leafSize < 4096 {
+		leafSize = 4096
+	}
+	for {
+		var rootEntries []entry
+		var leaves []byte
+		for i := 0; i < len(entries); i += int(leafSize) {
+			end := i + int(leafSize)
+			if end > len(entries) {
+				end = len(entries)
+			}
+			leaf, err := compress(serializeEntries(entries[i:end]), compression)
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, entry{
+				TileID: entries[i].TileID,
+				Offset: uint64(len(leaves)),
+				Length: uint32(len(leaf)),
+			})
+			leaves = append(leaves, leaf...)
+		}
+		root, err := compress(serializeEntries(rootEntries), compression)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(root) <= maxRootLength {
+			return root, leaves, nil
+		}
+		leafSize *= 1.2
+	}
+}
+
+func rotate(n uint32, x uint32, y uint32, rx uint32, ry uint32) (uint32, uint32) {
+	if ry == 0 {
+		if rx == 1 {
+			x = n - 1 - x
+			y = n - 1 - y
+		}
+		return y, x
+	}
+	return x, y
+}
+
+// zxyToTileID maps a tile onto the hilbert curve of its zoom level, offset by
+// the number of tiles on all lower zoom levels.
+func zxyToTileID(z uint8, x uint32, y uint32) uint64 {
+	acc := ((uint64(1) << (2 * uint64(z))) - 1) / 3
+	n := uint32(1) << z
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		x, y = rotate(n, x, y, rx, ry)
+	}
+	return acc + d
+}
+
+func tileIDToZxy(id uint64) (uint8, uint32, uint32) {
+	var acc uint64
+	var z uint8
+	for {
+		size := uint64(1) << (2 * uint64(z))
+		if acc+size > id {
+			break
+		}
+		acc += size
+		z++
+	}
+	n := uint32(1) << z
+	t := id - acc
+	var x, y uint32
+	for s := uint32(1); s < n; s *= 2 {
+		rx := uint32(1 & (t / 2))
+		ry := uint32(1 & (t ^ uint64(rx)))
+		x, y = rotate(s, x, y, rx, ry)
+		x += s * rx
+		y += s * ry
+		t /= 4
+	}
+	return z, x, y
+}
+
+// zoomRange returns the first tile ID of zoom level z and the first one of
+// z+1.
+func zoomRange(z uint8) (uint64, uint64) {
+	return zxyToTileID(z, 0, 0), zxyToTileID(z+1, 0, 0)
+}
+
+func toE7(deg float64) int32 {
+	return int32(math.Round(deg * 1e7))
+}
+
+func tileTypeToExt(t uint8) string {
+	switch t {
+	case tileTypeMvt:
+		return "pbf"
+	case tileTypePng:
+		return "png"
+	case tileTypeJpeg:
+		return "jpg"
+	case tileTypeWebp:
+		return "webp"
+	case tileTypeAvif:
+		return "avif"
+	}
+	return "png"
+}
+
+func extToTileType(ext string) uint8 {
+	switch ext {
+	case "pbf", "mvt":
+		return tileTypeMvt
+	case "png":
+		return tileTypePng
+	case "jpg", "jpeg":
+		return tileTypeJpeg
+	case "webp":
+		return tileTypeWebp
+	case "avif":
+		return tileTypeAvif
+	}
+	return tileTypeUnknown
+}
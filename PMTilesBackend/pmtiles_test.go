@@ -0,0 +1,129 @@
+package PMTilesBackend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileID(t *testing.T) {
+	assert.Equal(t, uint64(0), zxyToTileID(0, 0, 0))
+	assert.Equal(t, uint64(1), zxyToTileID(1, 0, 0))
+	assert.Equal(t, uint64(2), zxyToTileID(1, 0, 1))
+	assert.Equal(t, uint64(3), zxyToTileID(1, 1, 1))
+	assert.Equal(t, uint64(4), zxyToTileID(1, 1, 0))
+	assert.Equal(t, uint64(5), zxyToTileID(2, 0, 0))
+
+	for _, tc := range [][3]uint32{{0, 0, 0}, {3, 4, 2}, {8, 137, 89}, {14, 8800, 5700}} {
+		z, x, y := tileIDToZxy(zxyToTileID(uint8(tc[0]), tc[1], tc[2]))
+		assert.Equal(t, tc, [3]uint32{uint32(z), x, y})
+	}
+}
+
+func TestDirectoryRoundtrip(t *testing.T) {
+	entries := []entry{
+		{TileID: 0, Offset: 0, Length: 10, RunLength: 1},
+		{TileID: 1, Offset: 10, Length: 20, RunLength: 3},
+		{TileID: 9, Offset: 0, Length: 10, RunLength: 1},
+	}
+	result, err := deserializeEntries(serializeEntries(entries))
+	require.NoError(t, err)
+	assert.Equal(t, entries, result)
+}
+
+func TestArchiveRoundtrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	b, err := NewPMTilesBackend(path, true)
+	require.NoError(t, err)
+
+	// Enough tiles to require leaf directories
+	for x := 0; x < 512; x++ {
+		for y := 0; y < 512; y++ {
+			content := fmt.Sprintf("%d-%d", x, y)
+			if y%2 == 0 {
+				content = "same"
+			}
+			require.NoError(t, b.PutFile(ctx, fmt.Sprintf("9/%d/%d.png", x, y), bytes.NewBufferString(content)))
+		}
+	}
+	require.NoError(t, b.PutFile(ctx, "8/3/4.png", bytes.NewBufferString("low")))
+	require.NoError(t, b.Finalize())
+
+	b, err = NewPMTilesBackend(path, false)
+	require.NoError(t, err)
+	assert.True(t, b.header.Clustered)
+	assert.NotZero(t, b.header.LeafLength)
+	assert.Equal(t, uint8(8), b.header.MinZoom)
+	assert.Equal(t, uint8(9), b.header.MaxZoom)
+	assert.Equal(t, uint8(tileTypePng), b.header.TileType)
+
+	data, err := b.GetFile(ctx, "9/5/3.png")
+	require.NoError(t, err)
+	assert.Equal(t, "5-3", string(data))
+	data, err = b.GetFile(ctx, "9/5/4.png")
+	require.NoError(t, err)
+	assert.Equal(t, "same", string(data))
+	_, err = b.GetFile(ctx, "10/0/0.png")
+	assert.Error(t, err)
+
+	files, err := b.GetFilesRecursive(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, files, 512*512+1)
+	assert.Equal(t, "8/3/4.png", files[0])
+	files, err = b.GetFiles(ctx, "9/5/")
+	require.NoError(t, err)
+	require.Len(t, files, 512)
+	assert.Equal(t, "0.png", files[0])
+	assert.Equal(t, "511.png", files[511])
+
+	dirs, err := b.GetDirectories(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"8", "9"}, dirs)
+	dirs, err = b.GetDirectories(ctx, "9/")
+	require.NoError(t, err)
+	assert.Len(t, dirs, 512)
+	files, err = b.GetFiles(ctx, "8/3/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"4.png"}, files)
+	files, err = b.GetFiles(ctx, "8/4/")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestArchiveColumns(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	b, err := NewPMTilesBackend(path, true)
+	require.NoError(t, err)
+
+	// A sparse zoom level, the columns are listed in order
+	tiles := map[int][]int{1: {0, 7, 1000}, 500: {3}, 1023: {1023, 0}}
+	for x, rows := range tiles {
+		for _, y := range rows {
+			require.NoError(t, b.PutFile(ctx, fmt.Sprintf("10/%d/%d.png", x, y), bytes.NewBufferString("tile")))
+		}
+	}
+	require.NoError(t, b.Finalize())
+
+	b, err = NewPMTilesBackend(path, false)
+	require.NoError(t, err)
+	dirs, err := b.GetDirectories(ctx, "10/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "500", "1023"}, dirs)
+	for x, expected := range map[int][]string{
+		1:    {"0.png", "7.png", "1000.png"},
+		500:  {"3.png"},
+		1023: {"0.png", "1023.png"},
+		2:    {},
+	} {
+		files, err := b.GetFiles(ctx, fmt.Sprintf("10/%d/", x))
+		require.NoError(t, err)
+		assert.Equal(t, expected, files, "column %d", x)
+	}
+}
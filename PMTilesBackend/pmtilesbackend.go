@@ -0,0 +1,595 @@
+package PMTilesBackend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/v4lli/prioritile/TileMath"
+)
+
+// PMTilesBackend exposes a PMTiles v3 archive through the usual
+// {z}/{x}/{y}.<ext> paths. Archives can't be updated in place: tiles passed to
+// PutFile are spooled to a temporary file and a new archive replacing the old
+// one is written on Finalize. Until then, reads return the spooled tiles
+// first and fall back to the existing archive.
+type PMTilesBackend struct {
+	Path string
+
+	// existing archive, nil if the archive is new
+	file      *os.File
+	header    header
+	root      []entry
+	leavesMu  sync.Mutex
+	leaves    map[uint64][]entry
+	metadata  []byte
+	formatExt string
+
+	spoolMu sync.Mutex
+	spool   *os.File
+	spooled map[uint64]spoolEntry
+	written map[string]bool // formats written through PutFile
+}
+
+type spoolEntry struct {
+	Offset uint64
+	Length uint32
+	Hash   [sha1.Size]byte
+}
+
+func NewPMTilesBackend(path string, create bool) (*PMTilesBackend, error) {
+	path = strings.TrimPrefix(path, "pmtiles://")
+	b := &PMTilesBackend{
+		Path:      path,
+		leaves:    map[uint64][]entry{},
+		formatExt: "png",
+		spooled:   map[uint64]spoolEntry{},
+		written:   map[string]bool{},
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && create {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	b.file = f
+
+	buf := make([]byte, headerLength)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b.header, err = deserializeHeader(buf)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b.formatExt = tileTypeToExt(b.header.TileType)
+	b.root, err = b.readDirectory(b.header.RootOffset, b.header.RootLength)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: invalid root directory: %w", path, err)
+	}
+	if b.header.MetadataLength > 0 {
+		raw, err := b.readAt(b.header.MetadataOffset, b.header.MetadataLength)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		b.metadata, err = decompress(raw, b.header.InternalCompression)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// WriteOnce marks the backend as not being updatable in place.
+func (b *PMTilesBackend) WriteOnce() bool {
+	return true
+}
+
+func (b *PMTilesBackend) readAt(offset uint64, length uint64) ([]byte, error) {
+	buf := make([]byte, length)
+	_, err := b.file.ReadAt(buf, int64(offset))
+	return buf, err
+}
+
+func (b *PMTilesBackend) readDirectory(offset uint64, length uint64) ([]entry, error) {
+	raw, err := b.readAt(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	raw, err = decompress(raw, b.header.InternalCompression)
+	if err != nil {
+		return nil, err
+	}
+	return deserializeEntries(raw)
+}
+
+func (b *PMTilesBackend) leaf(e entry) ([]entry, error) {
+	b.leavesMu.Lock()
+	defer b.leavesMu.Unlock()
+	if entries, ok := b.leaves[e.Offset]; ok {
+		return entries, nil
+	}
+	entries, err := b.readDirectory(b.header.LeafOffset+e.Offset, uint64(e.Length))
+	if err != nil {
+		return nil, err
+	}
+	b.leaves[e.Offset] = entries
+	return entries, nil
+}
+
+// lookup finds the tile data entry for tileID in the existing archive.
+func (b *PMTilesBackend) lookup(tileID uint64) (entry, bool, error) {
+	entries := b.root
+	// The spec allows for at most three levels of directories
+	for depth := 0; depth < 4; depth++ {
+		e, ok := findTile(entries, tileID)
+		if !ok {
+			return entry{}, false, nil
+		}
+		if e.RunLength > 0 {
+			return e, true, nil
+		}
+		var err error
+		entries, err = b.leaf(e)
+		if err != nil {
+			return entry{}, false, err
+		}
+	}
+	return entry{}, false, fmt.Errorf("directory nesting too deep")
+}
+
+// walk calls fn for every tile data entry of the existing archive with IDs
+// in [from, to).
+func (b *PMTilesBackend) walk(entries []entry, from uint64, to uint64, fn func(e entry)) error {
+	for i, e := range entries {
+		if e.TileID >= to {
+			break
+		}
+		if e.RunLength == 0 {
+			if i+1 < len(entries) && entries[i+1].TileID <= from {
+				continue
+			}
+			leaf, err := b.leaf(e)
+			if err != nil {
+				return err
+			}
+			if err := b.walk(leaf, from, to, fn); err != nil {
+				return err
+			}
+		} else if e.TileID+uint64(e.RunLength) > from {
+			fn(e)
+		}
+	}
+	return nil
+}
+
+// parsePath splits "z/x/y.ext" into its coordinates and the extension.
+func parsePath(filename string) (uint8, uint32, uint32, string, error) {
+	parts := strings.Split(strings.TrimPrefix(filename, "/"), "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, "", fmt.Errorf("invalid tile path %s, expected format {z}/{x}/{y}.<ext>", filename)
+	}
+	fileParts := strings.SplitN(parts[2], ".", 2)
+	if len(fileParts) != 2 {
+		return 0, 0, 0, "", fmt.Errorf("invalid tile path %s, expected format {z}/{x}/{y}.<ext>", filename)
+	}
+	z, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	x, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	y, err := strconv.ParseUint(fileParts[0], 10, 32)
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	return uint8(z), uint32(x), uint32(y), fileParts[1], nil
+}
+
+func (b *PMTilesBackend) GetFile(ctx context.Context, filename string) ([]byte, error) {
+	z, x, y, _, err := parsePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	tileID := zxyToTileID(z, x, y)
+
+	b.spoolMu.Lock()
+	s, ok := b.spooled[tileID]
+	if ok {
+		buf := make([]byte, s.Length)
+		_, err := b.spool.ReadAt(buf, int64(s.Offset))
+		b.spoolMu.Unlock()
+		return buf, err
+	}
+	b.spoolMu.Unlock()
+
+	if b.file == nil {
+		return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+	}
+	e, ok, err := b.lookup(tileID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+	}
+	data, err := b.readAt(b.header.DataOffset+e.Offset, uint64(e.Length))
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data, b.header.TileCompression)
+}
+
+func (b *PMTilesBackend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
+	z, x, y, ext, err := parsePath(filename)
+	if err != nil {
+		return err
+	}
+
+	b.spoolMu.Lock()
+	defer b.spoolMu.Unlock()
+	if b.spool == nil {
+		b.spool, err = ioutil.TempFile(filepath.Dir(b.Path), "."+filepath.Base(b.Path)+".spool-*")
+		if err != nil {
+			return err
+		}
+	}
+	offset, err := b.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := b.spool.Write(content.Bytes()); err != nil {
+		return err
+	}
+	b.spooled[zxyToTileID(z, x, y)] = spoolEntry{
+		Offset: uint64(offset),
+		Length: uint32(content.Len()),
+		Hash:   sha1.Sum(content.Bytes()),
+	}
+	b.written[ext] = true
+	return nil
+}
+
+func (b *PMTilesBackend) FileExists(ctx context.Context, filename string) bool {
+	_, err := b.GetFile(ctx, filename)
+	return err == nil
+}
+
+func (b *PMTilesBackend) MkdirAll(ctx context.Context, dirname string) error {
+	// There are no directories in a pmtiles archive
+	return nil
+}
+
+// list returns the coordinates of all tiles in the existing archive, ordered
+// by tile ID. If z is non-negative, only tiles of that zoom level are listed.
+func (b *PMTilesBackend) list(z int) ([][3]uint32, error) {
+	if b.file == nil {
+		return nil, nil
+	}
+	from, to := uint64(0), uint64(1)<<63
+	if z >= 0 {
+		from, to = zoomRange(uint8(z))
+	}
+	var result [][3]uint32
+	err := b.walk(b.root, from, to, func(e entry) {
+		for id := e.TileID; id < e.TileID+uint64(e.RunLength); id++ {
+			if id < from || id >= to {
+				continue
+			}
+			tz, tx, ty := tileIDToZxy(id)
+			result = append(result, [3]uint32{uint32(tz), tx, ty})
+		}
+	})
+	return result, err
+}
+
+// next returns the lowest ID of a tile in the existing archive which is at
+// least from.
+func (b *PMTilesBackend) next(entries []entry, from uint64) (uint64, bool, error) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].TileID > from }) - 1
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(entries); i++ {
+		e := entries[i]
+		if e.RunLength == 0 {
+			leaf, err := b.leaf(e)
+			if err != nil {
+				return 0, false, err
+			}
+			if id, ok, err := b.next(leaf, from); ok || err != nil {
+				return id, ok, err
+			}
+		} else if e.TileID+uint64(e.RunLength) > from {
+			if e.TileID > from {
+				return e.TileID, true, nil
+			}
+			return from, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// column returns the rows of the tiles in column x of zoom level z in order.
+// Every square of the quadtree is a range of tile IDs, so the squares along
+// the column are searched for tiles, skipping the empty ones.
+func (b *PMTilesBackend) column(z uint8, x uint32) ([]uint32, error) {
+	if b.file == nil || uint64(x) >= uint64(1)<<z {
+		return nil, nil
+	}
+	first, _ := zoomRange(z)
+	var rows []uint32
+	var search func(y uint32, size uint64) error
+	search = func(y uint32, size uint64) error {
+		// The IDs of the square of size x size tiles starting at (x, y)
+		from := first + (zxyToTileID(z, x, y)-first)&^(size*size-1)
+		id, ok, err := b.next(b.root, from)
+		if err != nil || !ok || id >= from+size*size {
+			return err
+		}
+		if size == 1 {
+			rows = append(rows, y)
+			return nil
+		}
+		half := size / 2
+		if err := search(y, half); err != nil {
+			return err
+		}
+		return search(y+uint32(half), half)
+	}
+	return rows, search(0, uint64(1)<<z)
+}
+
+func (b *PMTilesBackend) GetDirectories(ctx context.Context, dirname string) ([]string, error) {
+	z, x, err := TileMath.ParseDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if x >= 0 || b.file == nil || b.header.AddressedTiles == 0 {
+		return nil, nil
+	}
+	var values []int
+	if z < 0 {
+		// The header knows the zoom levels
+		for v := int(b.header.MinZoom); v <= int(b.header.MaxZoom); v++ {
+			values = append(values, v)
+		}
+	} else {
+		from, to := zoomRange(uint8(z))
+		seen := map[uint32]bool{}
+		err := b.walk(b.root, from, to, func(e entry) {
+			for id := e.TileID; id < e.TileID+uint64(e.RunLength); id++ {
+				if id < from || id >= to {
+					continue
+				}
+				if _, x, _ := tileIDToZxy(id); !seen[x] {
+					seen[x] = true
+					values = append(values, int(x))
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Ints(values)
+	}
+	results := make([]string, len(values))
+	for i, v := range values {
+		results[i] = strconv.Itoa(v)
+	}
+	return results, nil
+}
+
+func (b *PMTilesBackend) GetFiles(ctx context.Context, dirname string) ([]string, error) {
+	z, x, err := TileMath.ParseDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if z < 0 || x < 0 || z > 31 {
+		// Tiles only ever live in {z}/{x}/
+		return nil, nil
+	}
+	rows, err := b.column(uint8(z), uint32(x))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, len(rows))
+	for i, y := range rows {
+		results[i] = fmt.Sprintf("%d.%s", y, b.formatExt)
+	}
+	return results, nil
+}
+
+// GetFilesRecursive lists tiles relative to dirname, ordered by zoom level.
+func (b *PMTilesBackend) GetFilesRecursive(ctx context.Context, dirname string) ([]string, error) {
+	z, x, err := TileMath.ParseDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	tiles, err := b.list(z)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimPrefix(dirname, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var results []string
+	for _, t := range tiles {
+		if x >= 0 && int(t[1]) != x {
+			continue
+		}
+		path := fmt.Sprintf("%d/%d/%d.%s", t[0], t[1], t[2], b.formatExt)
+		results = append(results, strings.TrimPrefix(path, prefix))
+	}
+	return results, nil
+}
+
+// Finalize writes all spooled tiles to a new, clustered archive which then
+// replaces the existing one.
+func (b *PMTilesBackend) Finalize() error {
+	b.spoolMu.Lock()
+	defer b.spoolMu.Unlock()
+	if b.spool == nil {
+		// nothing written, leave the archive alone
+		return nil
+	}
+	defer func() {
+		b.spool.Close()
+		os.Remove(b.spool.Name())
+		b.spool = nil
+	}()
+
+	ids := make([]uint64, 0, len(b.spooled))
+	for id := range b.spooled {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Assign offsets in the tile data section in tile ID order, deduplicating
+	// identical contents and run-length encoding consecutive repetitions.
+	var entries []entry
+	var order []uint64 // spooled tiles in the order they are written
+	offsets := map[[sha1.Size]byte]uint64{}
+	var dataLength uint64
+	for _, id := range ids {
+		s := b.spooled[id]
+		offset, dup := offsets[s.Hash]
+		if !dup {
+			offset = dataLength
+			offsets[s.Hash] = offset
+			order = append(order, id)
+			dataLength += uint64(s.Length)
+		}
+		if n := len(entries); n > 0 && entries[n-1].Offset == offset &&
+			entries[n-1].TileID+uint64(entries[n-1].RunLength) == id {
+			entries[n-1].RunLength++
+			continue
+		}
+		entries = append(entries, entry{TileID: id, Offset: offset, Length: s.Length, RunLength: 1})
+	}
+
+	root, leaves, err := buildDirectories(entries, compressionGzip)
+	if err != nil {
+		return err
+	}
+
+	tileType := uint8(tileTypeUnknown)
+	if len(b.written) == 1 {
+		for ext := range b.written {
+			tileType = extToTileType(ext)
+		}
+	}
+	metadata := b.metadata
+	if len(metadata) == 0 {
+		metadata, err = json.Marshal(map[string]string{
+			"name": strings.TrimSuffix(filepath.Base(b.Path), filepath.Ext(b.Path)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	metadata, err = compress(metadata, compressionGzip)
+	if err != nil {
+		return err
+	}
+
+	minZ, _, _ := tileIDToZxy(ids[0])
+	maxZ, _, _ := tileIDToZxy(ids[len(ids)-1])
+	var minX, minY, maxX, maxY uint32 = 1<<32 - 1, 1<<32 - 1, 0, 0
+	first, _ := zoomRange(maxZ)
+	for _, id := range ids[sort.Search(len(ids), func(i int) bool { return ids[i] >= first }):] {
+		_, x, y := tileIDToZxy(id)
+		if x < minX {
+			minX = x
+		}
+		if x > maxX {
+			maxX = x
+		}
+		if y < minY {
+			minY = y
+		}
+		if y > maxY {
+			maxY = y
+		}
+	}
+	z := int(maxZ)
+	minLon, maxLon := TileMath.Tile2Lon(int(minX), z), TileMath.Tile2Lon(int(maxX)+1, z)
+	minLat, maxLat := TileMath.Tile2Lat(int(maxY)+1, z), TileMath.Tile2Lat(int(minY), z)
+
+	h := header{
+		RootOffset:          headerLength,
+		RootLength:          uint64(len(root)),
+		MetadataOffset:      headerLength + uint64(len(root)),
+		MetadataLength:      uint64(len(metadata)),
+		AddressedTiles:      uint64(len(ids)),
+		TileEntries:         uint64(len(entries)),
+		TileContents:        uint64(len(order)),
+		Clustered:           true,
+		InternalCompression: compressionGzip,
+		TileCompression:     compressionNone,
+		TileType:            tileType,
+		MinZoom:             minZ,
+		MaxZoom:             maxZ,
+		MinLonE7:            toE7(minLon),
+		MinLatE7:            toE7(minLat),
+		MaxLonE7:            toE7(maxLon),
+		MaxLatE7:            toE7(maxLat),
+		CenterZoom:          minZ,
+		CenterLonE7:         toE7((minLon + maxLon) / 2),
+		CenterLatE7:         toE7((minLat + maxLat) / 2),
+	}
+	h.LeafOffset = h.MetadataOffset + h.MetadataLength
+	h.LeafLength = uint64(len(leaves))
+	h.DataOffset = h.LeafOffset + h.LeafLength
+	h.DataLength = dataLength
+
+	out, err := ioutil.TempFile(filepath.Dir(b.Path), "."+filepath.Base(b.Path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if err := out.Chmod(0644); err != nil {
+		out.Close()
+		return err
+	}
+	for _, part := range [][]byte{serializeHeader(h), root, metadata, leaves} {
+		if _, err := out.Write(part); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	for _, id := range order {
+		s := b.spooled[id]
+		if _, err := io.Copy(out, io.NewSectionReader(b.spool, int64(s.Offset), int64(s.Length))); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+	return os.Rename(out.Name(), b.Path)
+}
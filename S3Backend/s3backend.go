@@ -13,6 +13,12 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+func init() {
+	// Failed requests are retried by the caller (see -retries), retrying them
+	// here as well would multiply the attempts
+	minio.MaxRetry = 1
+}
+
 type S3Backend struct {
 	Client   *minio.Client
 	Bucket   string
@@ -63,8 +69,8 @@ func NewS3Backend(path string, timeout int) (*S3Backend, error) {
 	}, nil
 }
 
-func (s *S3Backend) GetFile(filename string) ([]byte, error) {
-	r, err := s.Client.GetObject(context.Background(), s.Bucket, s.BasePath+filename, minio.GetObjectOptions{})
+func (s *S3Backend) GetFile(ctx context.Context, filename string) ([]byte, error) {
+	r, err := s.Client.GetObject(ctx, s.Bucket, s.BasePath+filename, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -78,20 +84,20 @@ func (s *S3Backend) GetFile(filename string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (s *S3Backend) PutFile(filename string, content *bytes.Buffer) error {
+func (s *S3Backend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
 	opts := minio.PutObjectOptions{}
 	opts.UserMetadata = make(map[string]string)
 	opts.UserMetadata["x-amz-acl"] = "public-read"
-	_, err := s.Client.PutObject(context.Background(), s.Bucket, s.BasePath+filename, content, int64(content.Len()),
+	_, err := s.Client.PutObject(ctx, s.Bucket, s.BasePath+filename, content, int64(content.Len()),
 		opts)
 	return err
 }
 
-func (s *S3Backend) GetDirectories(dirname string) ([]string, error) {
+func (s *S3Backend) GetDirectories(ctx context.Context, dirname string) ([]string, error) {
 	prefix := s.BasePath + dirname
 	var result []string
 	for object := range s.Client.ListObjects(
-		context.Background(),
+		ctx,
 		s.Bucket,
 		minio.ListObjectsOptions{Prefix: prefix, Recursive: false},
 	) {
@@ -108,11 +114,11 @@ func (s *S3Backend) GetDirectories(dirname string) ([]string, error) {
 	return result, nil
 }
 
-func (s *S3Backend) GetFiles(dirname string) ([]string, error) {
+func (s *S3Backend) GetFiles(ctx context.Context, dirname string) ([]string, error) {
 	prefix := s.BasePath + dirname
 	var result []string
 	for object := range s.Client.ListObjects(
-		context.Background(),
+		ctx,
 		s.Bucket,
 		minio.ListObjectsOptions{Prefix: prefix, Recursive: false},
 	) {
@@ -127,10 +133,10 @@ func (s *S3Backend) GetFiles(dirname string) ([]string, error) {
 	return result, nil
 }
 
-func (s *S3Backend) GetFilesRecursive(dirname string) ([]string, error) {
+func (s *S3Backend) GetFilesRecursive(ctx context.Context, dirname string) ([]string, error) {
 	prefix := s.BasePath + dirname
 	var result []string
-	for object := range s.Client.ListObjects(context.Background(),
+	for object := range s.Client.ListObjects(ctx,
 		s.Bucket,
 		minio.ListObjectsOptions{Prefix: prefix, Recursive: true},
 	) {
@@ -143,13 +149,23 @@ func (s *S3Backend) GetFilesRecursive(dirname string) ([]string, error) {
 	return result, nil
 }
 
-func (s *S3Backend) MkdirAll(dirname string) error {
+func (s *S3Backend) MkdirAll(ctx context.Context, dirname string) error {
 	// I think this is not necessary on S3
 	return nil
 }
 
-func (s *S3Backend) FileExists(filename string) bool {
-	_, err := s.Client.StatObject(context.Background(), s.Bucket, s.BasePath+filename,
+func (s *S3Backend) FileExists(ctx context.Context, filename string) bool {
+	_, err := s.Client.StatObject(ctx, s.Bucket, s.BasePath+filename,
 		minio.StatObjectOptions{})
 	return err == nil
 }
+
+// GetFileVersion returns the ETag of an object.
+func (s *S3Backend) GetFileVersion(ctx context.Context, filename string) (string, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, s.BasePath+filename,
+		minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, nil
+}
@@ -0,0 +1,46 @@
+// Package TileMath has the tile coordinate helpers shared by the main package
+// and the storage backends.
+package TileMath
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Tile2Lon and Tile2Lat return the north-west corner of an XYZ tile in
+// degrees.
+func Tile2Lon(x int, z int) float64 {
+	return float64(x)/math.Exp2(float64(z))*360.0 - 180.0
+}
+
+func Tile2Lat(y int, z int) float64 {
+	n := math.Pi - 2.0*math.Pi*float64(y)/math.Exp2(float64(z))
+	return 180.0 / math.Pi * math.Atan(0.5*(math.Exp(n)-math.Exp(-n)))
+}
+
+// ParseDir splits a directory name like "", "z/" or "z/x/" into its
+// components; missing components are returned as -1.
+func ParseDir(dirname string) (int, int, error) {
+	dirname = strings.Trim(dirname, "/")
+	if dirname == "" {
+		return -1, -1, nil
+	}
+	parts := strings.Split(dirname, "/")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("invalid directory %s", dirname)
+	}
+	z, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return z, -1, nil
+	}
+	x, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return z, x, nil
+}
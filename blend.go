@@ -0,0 +1,75 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// blendFuncs implement the separable blend modes of the W3C compositing spec
+// on non-premultiplied color channels in the range 0-1.
+var blendFuncs = map[string]func(cb, cs float64) float64{
+	"multiply": func(cb, cs float64) float64 { return cb * cs },
+	"screen":   func(cb, cs float64) float64 { return cb + cs - cb*cs },
+	"darken":   math.Min,
+	"lighten":  math.Max,
+}
+
+// blendLayer paints src onto dst using the given blend mode and opacity.
+func blendLayer(dst *image.RGBA, src image.Image, mode string, opacity float64) {
+	if mode == "over" || mode == "" {
+		if opacity >= 1 {
+			draw.Draw(dst, src.Bounds(), src, src.Bounds().Min, draw.Over)
+		} else {
+			mask := image.NewUniform(color.Alpha{A: uint8(math.Round(opacity * 255))})
+			draw.DrawMask(dst, src.Bounds(), src, src.Bounds().Min, mask, image.Point{}, draw.Over)
+		}
+		return
+	}
+
+	// Everything else is done pixel by pixel on premultiplied 8 bit RGBA
+	layer, ok := src.(*image.RGBA)
+	if !ok {
+		layer = image.NewRGBA(src.Bounds())
+		draw.Draw(layer, layer.Bounds(), src, src.Bounds().Min, draw.Src)
+	}
+	b := layer.Bounds().Intersect(dst.Bounds())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			s := layer.PixOffset(x, y)
+			d := dst.PixOffset(x, y)
+			blendPixel(dst.Pix[d:d+4:d+4], layer.Pix[s:s+4:s+4], mode, opacity)
+		}
+	}
+}
+
+func blendPixel(dst []byte, src []byte, mode string, opacity float64) {
+	if src[3] == 0 {
+		return
+	}
+	if mode == "replace" {
+		// Wherever the source has data, it replaces what's below
+		for i := range dst {
+			dst[i] = uint8(math.Round(float64(dst[i])*(1-opacity) + float64(src[i])*opacity))
+		}
+		return
+	}
+
+	blend := blendFuncs[mode]
+	as := float64(src[3]) / 255 * opacity
+	ab := float64(dst[3]) / 255
+	ao := as + ab*(1-as)
+	for i := 0; i < 3; i++ {
+		cs := float64(src[i]) / float64(src[3])
+		cb := 0.0
+		if dst[3] > 0 {
+			cb = float64(dst[i]) / float64(dst[3])
+		}
+		// The blended color only applies where there is a backdrop
+		mixed := (1-ab)*cs + ab*blend(cb, cs)
+		dst[i] = uint8(math.Round((as*mixed + (1-as)*ab*cb) * 255))
+	}
+	dst[3] = uint8(math.Round(ao * 255))
+}
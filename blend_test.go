@@ -0,0 +1,54 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uniformRGBA(c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestBlendLayer(t *testing.T) {
+	backdrop := color.RGBA{200, 100, 0, 255}
+	src := uniformRGBA(color.RGBA{128, 255, 0, 255})
+
+	cases := []struct {
+		mode     string
+		opacity  float64
+		expected color.RGBA
+	}{
+		{"over", 1, color.RGBA{128, 255, 0, 255}},
+		{"over", 0.5, color.RGBA{164, 178, 0, 255}},
+		{"multiply", 1, color.RGBA{100, 100, 0, 255}},
+		{"screen", 1, color.RGBA{228, 255, 0, 255}},
+		{"darken", 1, color.RGBA{128, 100, 0, 255}},
+		{"lighten", 1, color.RGBA{200, 255, 0, 255}},
+		{"replace", 1, color.RGBA{128, 255, 0, 255}},
+		{"multiply", 0, backdrop},
+	}
+	for _, tc := range cases {
+		dst := uniformRGBA(backdrop)
+		blendLayer(dst, src, tc.mode, tc.opacity)
+		assert.Equal(t, tc.expected, dst.RGBAAt(1, 1), "%s %v", tc.mode, tc.opacity)
+	}
+
+	// Without a backdrop, the source is painted as-is
+	dst := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	blendLayer(dst, src, "multiply", 1)
+	assert.Equal(t, color.RGBA{128, 255, 0, 255}, dst.RGBAAt(0, 0))
+
+	// Transparent source pixels keep the backdrop, even when replacing
+	dst = uniformRGBA(backdrop)
+	blendLayer(dst, image.NewRGBA(image.Rect(0, 0, 2, 2)), "replace", 1)
+	assert.Equal(t, backdrop, dst.RGBAAt(0, 0))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// point is a position in normalized Web Mercator coordinates: (0, 0) is the
+// top left corner of tile 0/0/0, (1, 1) its bottom right corner.
+type point struct {
+	X, Y float64
+}
+
+// Cutline is a (multi)polygon limiting the area a source contributes to.
+type Cutline struct {
+	// polygons, each made up of an outer ring and optional holes
+	polygons [][][]point
+	min, max point
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// LoadCutline reads the polygons of a GeoJSON file (EPSG:4326). Feature
+// collections, features, geometry collections, polygons and multipolygons are
+// supported, all other geometries are ignored.
+func LoadCutline(path string) (*Cutline, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root geoJSON
+	if err := json.Unmarshal(f, &root); err != nil {
+		return nil, fmt.Errorf("invalid cutline %s: %w", path, err)
+	}
+	c := &Cutline{min: point{math.Inf(1), math.Inf(1)}, max: point{math.Inf(-1), math.Inf(-1)}}
+	if err := c.add(&root); err != nil {
+		return nil, fmt.Errorf("invalid cutline %s: %w", path, err)
+	}
+	if len(c.polygons) == 0 {
+		return nil, fmt.Errorf("cutline %s contains no polygons", path)
+	}
+	return c, nil
+}
+
+func (c *Cutline) add(g *geoJSON) error {
+	switch g.Type {
+	case "FeatureCollection":
+		for i := range g.Features {
+			if err := c.add(&g.Features[i]); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if g.Geometry != nil {
+			return c.add(g.Geometry)
+		}
+	case "GeometryCollection":
+		for i := range g.Geometries {
+			if err := c.add(&g.Geometries[i]); err != nil {
+				return err
+			}
+		}
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygon); err != nil {
+			return err
+		}
+		c.addPolygon(polygon)
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return err
+		}
+		for _, polygon := range polygons {
+			c.addPolygon(polygon)
+		}
+	}
+	return nil
+}
+
+func (c *Cutline) addPolygon(rings [][][]float64) {
+	var polygon [][]point
+	for _, ring := range rings {
+		var projected []point
+		for _, position := range ring {
+			if len(position) < 2 {
+				continue
+			}
+			p := lonLatToPoint(position[0], position[1])
+			c.min.X, c.min.Y = math.Min(c.min.X, p.X), math.Min(c.min.Y, p.Y)
+			c.max.X, c.max.Y = math.Max(c.max.X, p.X), math.Max(c.max.Y, p.Y)
+			projected = append(projected, p)
+		}
+		if len(projected) >= 3 {
+			polygon = append(polygon, projected)
+		}
+	}
+	if len(polygon) > 0 {
+		c.polygons = append(c.polygons, polygon)
+	}
+}
+
+func lonLatToPoint(lon, lat float64) point {
+	// Clamp to the extent of Web Mercator
+	lat = math.Max(math.Min(lat, 85.0511287798), -85.0511287798)
+	sin := math.Sin(lat * math.Pi / 180)
+	return point{
+		X: (lon + 180) / 360,
+		Y: 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi),
+	}
+}
+
+// contains reports whether p is inside the cutline (even-odd rule within
+// each polygon, so holes are excluded).
+func (c *Cutline) contains(p point) bool {
+	for _, polygon := range c.polygons {
+		inside := false
+		for _, ring := range polygon {
+			for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+				a, b := ring[i], ring[j]
+				if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+					inside = !inside
+				}
+			}
+		}
+		if inside {
+			return true
+		}
+	}
+	return false
+}
+
+func tileRect(z, x, y int) (point, point) {
+	n := float64(int(1) << uint(z))
+	return point{float64(x) / n, float64(y) / n}, point{float64(x+1) / n, float64(y+1) / n}
+}
+
+// Intersects reports whether any part of the tile z/x/y is inside the cutline.
+func (c *Cutline) Intersects(z, x, y int) bool {
+	min, max := tileRect(z, x, y)
+	if max.X < c.min.X || min.X > c.max.X || max.Y < c.min.Y || min.Y > c.max.Y {
+		return false
+	}
+	// Either an edge crosses the tile or the tile is entirely inside or
+	// outside of the polygons
+	for _, polygon := range c.polygons {
+		for _, ring := range polygon {
+			for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+				if segmentIntersectsRect(ring[j], ring[i], min, max) {
+					return true
+				}
+			}
+		}
+	}
+	return c.contains(point{(min.X + max.X) / 2, (min.Y + max.Y) / 2})
+}
+
+// segmentIntersectsRect clips the segment a-b against the rectangle
+// (Liang-Barsky).
+func segmentIntersectsRect(a, b, min, max point) bool {
+	t0, t1 := 0.0, 1.0
+	dx, dy := b.X-a.X, b.Y-a.Y
+	for _, edge := range [4][2]float64{{-dx, a.X - min.X}, {dx, max.X - a.X}, {-dy, a.Y - min.Y}, {dy, max.Y - a.Y}} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return false
+			}
+			t0 = math.Max(t0, r)
+		} else {
+			if r < t0 {
+				return false
+			}
+			t1 = math.Min(t1, r)
+		}
+	}
+	return true
+}
+
+// Mask rasterizes the cutline for the tile z/x/y, sampling at the pixel
+// centers.
+func (c *Cutline) Mask(z, x, y int, bounds image.Rectangle) *image.Alpha {
+	mask := image.NewAlpha(bounds)
+	min, max := tileRect(z, x, y)
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	scaleX, scaleY := w/(max.X-min.X), h/(max.Y-min.Y)
+
+	for py := 0; py < bounds.Dy(); py++ {
+		scanY := min.Y + (float64(py)+0.5)/scaleY
+		for _, polygon := range c.polygons {
+			// Collect the crossings of the scanline with all rings, the
+			// spans between pairs of them are inside (even-odd)
+			var crossings []float64
+			for _, ring := range polygon {
+				for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+					a, b := ring[i], ring[j]
+					if (a.Y > scanY) != (b.Y > scanY) {
+						crossings = append(crossings, ((b.X-a.X)*(scanY-a.Y)/(b.Y-a.Y)+a.X-min.X)*scaleX)
+					}
+				}
+			}
+			sort.Float64s(crossings)
+			for i := 0; i+1 < len(crossings); i += 2 {
+				// Pixels whose center lies within the span
+				from := int(math.Max(math.Ceil(crossings[i]-0.5), 0))
+				to := int(math.Min(math.Ceil(crossings[i+1]-0.5), w))
+				for px := from; px < to; px++ {
+					mask.Pix[mask.PixOffset(bounds.Min.X+px, bounds.Min.Y+py)] = 0xff
+				}
+			}
+		}
+	}
+	return mask
+}
+
+// applyCutline makes everything outside the cutline transparent.
+func applyCutline(img image.Image, c *Cutline, tile TileDescriptor) image.Image {
+	b := img.Bounds()
+	result := image.NewRGBA(b)
+	draw.DrawMask(result, b, img, b.Min, c.Mask(tile.Z, tile.X, tile.Y, b), b.Min, draw.Src)
+	return result
+}
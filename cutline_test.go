@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCutline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cutline.geojson")
+	// Western hemisphere with a hole around 90°W on the equator
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [
+			[[-180, -85], [-1, -85], [-1, 85], [-180, 85], [-180, -85]],
+			[[-100, -10], [-80, -10], [-80, 10], [-100, 10], [-100, -10]]
+		]}},
+		{"type": "Feature", "properties": {}, "geometry": {"type": "Point", "coordinates": [10, 10]}}
+	]}`), 0644))
+	cutline, err := LoadCutline(path)
+	require.NoError(t, err)
+
+	assert.True(t, cutline.Intersects(0, 0, 0))
+	assert.True(t, cutline.Intersects(1, 0, 0))
+	assert.True(t, cutline.Intersects(1, 0, 1))
+	assert.False(t, cutline.Intersects(1, 1, 0))
+	assert.False(t, cutline.Intersects(1, 1, 1))
+	// Inside the hole
+	assert.False(t, cutline.Intersects(8, 64, 128))
+	// Entirely inside the polygon
+	assert.True(t, cutline.Intersects(8, 10, 100))
+
+	mask := cutline.Mask(0, 0, 0, image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			assert.Equal(t, x < 2, mask.AlphaAt(x, y).A == 0xff, "%d/%d", x, y)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	result := applyCutline(img, cutline, TileDescriptor{Z: 0, X: 0, Y: 0})
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, result.At(0, 0))
+	assert.Equal(t, color.RGBA{}, result.At(3, 0))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "Point", "coordinates": [10, 10]}`), 0644))
+	_, err = LoadCutline(path)
+	assert.Error(t, err)
+}
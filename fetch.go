@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// fetchedSource is the encoded tile of one source.
+type fetchedSource struct {
+	source  *TilesetDescriptor
+	tile    TileDescriptor
+	content []byte
+	version string
+	err     *TileError
+}
+
+// FetchedTile holds what is needed to compose a tile: the encoded tiles of
+// its sources, topmost first, down to the first one known to be opaque.
+type FetchedTile struct {
+	Tile    TileDescriptor
+	sources []fetchedSource
+	// The current target tile, nil if it doesn't exist or hasn't been read
+	target      []byte
+	targetFetch bool
+	// The sources below the tile which looked opaque, not fetched yet
+	rest     []fetchedSource
+	versions bool
+}
+
+// opaqueSource reports whether a source tile covers everything below it once
+// its encoded content is opaque.
+func opaqueSource(source *TilesetDescriptor) bool {
+	options := source.Options
+	return options.Unmodified() && (options.Blend == "over" || options.Blend == "replace")
+}
+
+// opaqueFormat reports whether a tile can't have transparent pixels judging
+// by its extension alone.
+func opaqueFormat(tile TileDescriptor) bool {
+	return tile.Format == "jpg" || tile.Format == "jpeg"
+}
+
+// opaqueEncoding reports whether an encoded tile can't have transparent
+// pixels: JPEGs, lossy WebPs without an alpha channel and PNGs which have
+// neither an alpha channel nor a transparent color. It's false if unsure.
+func opaqueEncoding(content []byte) bool {
+	if bytes.HasPrefix(content, []byte("\xff\xd8\xff")) {
+		return true
+	}
+	if len(content) >= 16 && string(content[:4]) == "RIFF" && string(content[8:16]) == "WEBPVP8 " {
+		return true
+	}
+	if !bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")) {
+		return false
+	}
+	opaque := false
+	for p := 8; p+8 <= len(content); {
+		length := int(binary.BigEndian.Uint32(content[p:]))
+		chunk := string(content[p+4 : p+8])
+		switch chunk {
+		case "IHDR":
+			if p+8+10 > len(content) {
+				return false
+			}
+			// Grayscale, truecolor or paletted without alpha
+			colorType := content[p+8+9]
+			opaque = colorType == 0 || colorType == 2 || colorType == 3
+		case "tRNS":
+			return false
+		case "IDAT":
+			return opaque
+		}
+		if length < 0 || length > len(content) {
+			return false
+		}
+		p += 12 + length
+	}
+	return false
+}
+
+// Fetch reads the source tiles (and versions, if needed for the manifest) of
+// a tile concurrently. Sources below a tile which is known to be opaque from
+// its extension aren't fetched, and fetches of sources below a tile which
+// turns out to be opaque once fetched are cancelled. Whether the other tiles
+// are opaque is only known after decoding them, see Compose.
+func (m *Merger) Fetch(ctx context.Context, tile TileDescriptor, sources []*TilesetDescriptor, versions bool) (*FetchedTile, error) {
+	counterFetchStart := time.Now()
+	fetched := &FetchedTile{Tile: tile, versions: versions}
+	for i := len(sources) - 1; i >= 0; i-- {
+		if sourceTile, ok := sources[i].Resolve(tile); ok {
+			fetched.rest = append(fetched.rest, fetchedSource{source: sources[i], tile: sourceTile})
+		}
+	}
+	if err := m.fetchMore(ctx, fetched); err != nil {
+		return nil, err
+	}
+	observe(m.Counters.fetch, counterFetchStart)
+	return fetched, nil
+}
+
+// fetchMore fetches the sources of fetched.rest down to the next one which is
+// opaque, see Fetch, and leaves the ones below in fetched.rest.
+func (m *Merger) fetchMore(ctx context.Context, fetched *FetchedTile) error {
+	tile, candidates := fetched.Tile, fetched.rest
+	fetched.rest = nil
+	for start := 0; start <= len(candidates); {
+		// Fetch down to the next tile which should be opaque, the ones below
+		// are only needed if it isn't
+		end := start
+		for end < len(candidates) {
+			end++
+			if opaqueFormat(candidates[end-1].tile) && opaqueSource(candidates[end-1].source) {
+				break
+			}
+		}
+		batch := candidates[start:end]
+		bottom := end == len(candidates) && m.Target != nil
+
+		// Every fetch can be cancelled on its own
+		contexts := make([]context.Context, len(batch)+1)
+		cancels := make([]context.CancelFunc, len(batch)+1)
+		for k := range contexts {
+			contexts[k], cancels[k] = context.WithCancel(ctx)
+		}
+		var mu sync.Mutex
+		cutoff := len(batch)
+		var wg sync.WaitGroup
+		for k := range batch {
+			wg.Add(1)
+			go func(k int) {
+				defer wg.Done()
+				m.fetchSource(contexts[k], tile, &batch[k], fetched.versions)
+				if batch[k].err != nil || !opaqueSource(batch[k].source) || !opaqueEncoding(batch[k].content) {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if k < cutoff {
+					cutoff = k
+					for _, cancel := range cancels[k+1:] {
+						cancel()
+					}
+				}
+			}(k)
+		}
+		if bottom {
+			// Nothing opaque so far, so the target will likely show through
+			fetched.targetFetch = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if f, err := m.Target.GetFile(contexts[len(batch)], tile.String()); err == nil {
+					fetched.target = f
+				}
+			}()
+		}
+		wg.Wait()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if cutoff < len(batch) {
+			fetched.sources = append(fetched.sources, batch[:cutoff+1]...)
+			// Kept in case the opaque tile can't be used after all
+			for _, c := range candidates[start+cutoff+1:] {
+				fetched.rest = append(fetched.rest, fetchedSource{source: c.source, tile: c.tile})
+			}
+			fetched.target, fetched.targetFetch = nil, false
+			return nil
+		}
+		fetched.sources = append(fetched.sources, batch...)
+		if end == len(candidates) {
+			return nil
+		}
+		start = end
+	}
+	return nil
+}
+
+func (m *Merger) fetchSource(ctx context.Context, tile TileDescriptor, s *fetchedSource, versions bool) {
+	f, err := s.source.Backend.GetFile(ctx, s.tile.String())
+	if err != nil {
+		s.err = &TileError{tile, s.source.Name, stageFetch, err}
+		return
+	}
+	if versions {
+		version, err := fileVersion(ctx, s.source.Backend, s.tile.String(), f)
+		if err != nil {
+			s.err = &TileError{tile, s.source.Name, stageFetch, fmt.Errorf("no version: %w", err)}
+			return
+		}
+		s.version = version
+	}
+	s.content = f
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBackend counts the files read, optionally failing all of them.
+type countingBackend struct {
+	StorageBackend
+	reads int32
+	err   error
+}
+
+func (b *countingBackend) GetFile(ctx context.Context, filename string) ([]byte, error) {
+	atomic.AddInt32(&b.reads, 1)
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.StorageBackend.GetFile(ctx, filename)
+}
+
+// testJPEGTileset returns a tileset with a single tile 0/0/0.jpg filled with c.
+func testJPEGTileset(t *testing.T, name string, c color.Color) *TilesetDescriptor {
+	tileset := testTileset(t, name, 256, 0, color.NRGBA{})
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b, a := c.RGBA()
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, img, nil))
+	require.NoError(t, tileset.Backend.PutFile(context.Background(), "0/0/0.jpg", buf))
+	tileset.index = map[[3]int]string{{0, 0, 0}: "jpg"}
+	return tileset
+}
+
+func TestOpaqueEncoding(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		tileset  *TilesetDescriptor
+		filename string
+		opaque   bool
+	}{
+		{testTileset(t, "opaque", 256, 256, color.NRGBA{R: 0xff, A: 0xff}), "0/0/0.png", true},
+		{testTileset(t, "half", 256, 128, color.NRGBA{R: 0xff, A: 0xff}), "0/0/0.png", false},
+		{testJPEGTileset(t, "jpeg", color.White), "0/0/0.jpg", true},
+	} {
+		content, err := test.tileset.Backend.GetFile(ctx, test.filename)
+		require.NoError(t, err)
+		assert.Equal(t, test.opaque, opaqueEncoding(content), test.tileset.Name)
+	}
+	assert.False(t, opaqueEncoding([]byte("garbage")))
+	assert.False(t, opaqueEncoding([]byte("\x89PNG\r\n\x1a\n\x00\x00")))
+}
+
+func TestFetchShortCircuit(t *testing.T) {
+	ctx := context.Background()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	below := testTileset(t, "below", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	counting := &countingBackend{StorageBackend: below.Backend}
+	below.Backend = counting
+	top := testJPEGTileset(t, "top", color.White)
+	sources := []*TilesetDescriptor{below, top}
+
+	// Nothing below a JPEG tile is fetched
+	content, err := (&Merger{}).Merge(ctx, tile, sources, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&counting.reads))
+	img, _, err := image.Decode(bytes.NewReader(content))
+	require.NoError(t, err)
+	r, g, b, _ := img.At(0, 0).RGBA()
+	assert.True(t, r > 0xf000 && g > 0xf000 && b > 0xf000)
+
+	// unless it can't be used
+	top.Backend = &countingBackend{StorageBackend: top.Backend, err: errors.New("unavailable")}
+	content, err = (&Merger{BestEffort: true}).Merge(ctx, tile, sources, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counting.reads))
+	raw, err := counting.StorageBackend.GetFile(ctx, "0/0/0.png")
+	require.NoError(t, err)
+	assert.Equal(t, raw, content)
+
+	// or isn't painted opaque
+	top.Backend = top.Backend.(*countingBackend).StorageBackend
+	top.Options.Opacity = 0.5
+	_, err = (&Merger{}).Merge(ctx, tile, sources, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counting.reads))
+}
+
+func TestFetchUnusableOpaqueTile(t *testing.T) {
+	ctx := context.Background()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	below := testTileset(t, "below", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	middle := testTileset(t, "middle", 256, 128, color.NRGBA{G: 0xff, A: 0xff})
+	counting := &countingBackend{StorageBackend: below.Backend}
+	below.Backend = counting
+	// Looks like a JPEG, but can't be decoded
+	top := testJPEGTileset(t, "top", color.White)
+	require.NoError(t, top.Backend.PutFile(ctx, "0/0/0.jpg", bytes.NewBufferString("\xff\xd8\xff broken")))
+	sources := []*TilesetDescriptor{below, middle, top}
+
+	merger := &Merger{BestEffort: true}
+	fetched, err := merger.Fetch(ctx, tile, sources, false)
+	require.NoError(t, err)
+	assert.Len(t, fetched.sources, 1)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&counting.reads))
+
+	// The layers below take its place
+	content, err := merger.Compose(ctx, fetched, nil)
+	require.NoError(t, err)
+	img, _, err := image.Decode(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA{G: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(0, 0)))
+	assert.Equal(t, color.RGBA{R: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(200, 0)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counting.reads))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"golang.org/x/image/draw"
+)
+
+// formatExtensions maps the supported output formats to the filename
+// extension of the target tiles. PNG, JPEG and WebP sources can be decoded,
+// regardless of the output format.
+var formatExtensions = map[string]string{
+	"png":           "png",
+	"jpeg":          "jpg",
+	"webp":          "webp",
+	"webp-lossless": "webp",
+}
+
+// OutputFormat describes how merged tiles are encoded.
+type OutputFormat struct {
+	Name string
+	// Quality (0-100) for JPEG and lossy WebP
+	Quality int
+	// Transparent pixels are painted onto this color for formats without an
+	// alpha channel (JPEG). If nil, such tiles are rejected.
+	Background *color.NRGBA
+}
+
+// DefaultOutputFormat keeps the original behavior of writing PNGs.
+var DefaultOutputFormat = &OutputFormat{Name: "png"}
+
+// NewOutputFormat validates the -format, -quality and -background options.
+func NewOutputFormat(name string, quality int, background string) (*OutputFormat, error) {
+	if _, ok := formatExtensions[name]; !ok {
+		return nil, fmt.Errorf("unknown output format %s, valid formats are: png, jpeg, webp, webp-lossless", name)
+	}
+	if quality < 0 || quality > 100 {
+		return nil, fmt.Errorf("quality must be between 0 and 100")
+	}
+	f := &OutputFormat{Name: name, Quality: quality}
+	if len(background) > 0 {
+		key, err := parseNoData(strings.TrimPrefix(background, "#"))
+		if err != nil || key.tolerance != 0 {
+			return nil, fmt.Errorf("invalid background color %s, expected RRGGBB", background)
+		}
+		f.Background = &key.color
+	}
+	return f, nil
+}
+
+// Ext returns the filename extension of tiles in this format.
+func (f *OutputFormat) Ext() string {
+	return formatExtensions[f.Name]
+}
+
+// ContentType returns the MIME type of tiles in this format.
+func (f *OutputFormat) ContentType() string {
+	if f.Name == "jpeg" {
+		return "image/jpeg"
+	}
+	return "image/" + f.Ext()
+}
+
+// Encode writes img in this format. For JPEG, transparent pixels are flattened
+// onto the background color or rejected.
+func (f *OutputFormat) Encode(w io.Writer, img image.Image) error {
+	switch f.Name {
+	case "jpeg":
+		if _, hasAlphaPixel := analyzeAlpha(img); hasAlphaPixel {
+			if f.Background == nil {
+				return fmt.Errorf("tile has transparent pixels which can't be stored as JPEG, set -background")
+			}
+			flattened := image.NewRGBA(img.Bounds())
+			draw.Draw(flattened, flattened.Bounds(), image.NewUniform(f.Background), image.Point{}, draw.Src)
+			draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+			img = flattened
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: f.Quality})
+	case "webp":
+		return webp.Encode(w, img, &webp.Options{Quality: float32(f.Quality)})
+	case "webp-lossless":
+		return webp.Encode(w, img, &webp.Options{Lossless: true})
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// sameFormat reports whether a tile with the given filename extension is
+// already encoded in this format, so it can be copied as-is.
+func (f *OutputFormat) sameFormat(ext string) bool {
+	ext = strings.ToLower(ext)
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+	return ext == f.Ext()
+}
+
+// keepsEncoding reports whether a tile which is already in this format (see
+// sameFormat) can be copied as-is without losing anything the format
+// promises: lossless WebP must not be made up of lossy WebP tiles.
+func (f *OutputFormat) keepsEncoding(content []byte) bool {
+	return f.Name != "webp-lossless" || losslessWebP(content)
+}
+
+// losslessWebP reports whether content is a WebP image using lossless (VP8L)
+// compression.
+func losslessWebP(content []byte) bool {
+	if len(content) < 12 || string(content[:4]) != "RIFF" || string(content[8:12]) != "WEBP" {
+		return false
+	}
+	for p := 12; p+8 <= len(content); {
+		switch string(content[p : p+4]) {
+		case "VP8L":
+			return true
+		case "VP8 ", "ANIM":
+			return false
+		}
+		length := int(binary.LittleEndian.Uint32(content[p+4:]))
+		if length < 0 || length > len(content) {
+			return false
+		}
+		// Chunks are padded to an even length
+		p += 8 + length + length&1
+	}
+	return false
+}
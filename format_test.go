@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/chai2010/webp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputFormat(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.SetNRGBA(0, 0, color.NRGBA{})
+
+	for _, name := range []string{"png", "webp", "webp-lossless"} {
+		format, err := NewOutputFormat(name, 90, "")
+		require.NoError(t, err)
+		buf := new(bytes.Buffer)
+		require.NoError(t, format.Encode(buf, img), name)
+		decoded, decodedFormat, err := image.Decode(buf)
+		require.NoError(t, err, name)
+		assert.Equal(t, format.Ext(), decodedFormat, name)
+		_, _, _, a := decoded.At(0, 0).RGBA()
+		assert.Zero(t, a, name)
+	}
+
+	format, err := NewOutputFormat("jpeg", 90, "")
+	require.NoError(t, err)
+	assert.Equal(t, "jpg", format.Ext())
+	assert.Error(t, format.Encode(new(bytes.Buffer), img))
+
+	format, err = NewOutputFormat("jpeg", 90, "#000000")
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, format.Encode(buf, img))
+	decoded, decodedFormat, err := image.Decode(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", decodedFormat)
+	r, _, _, _ := decoded.At(0, 0).RGBA()
+	assert.Less(t, r, uint32(0x2000))
+	assert.True(t, format.sameFormat("JPEG"))
+	assert.False(t, format.sameFormat("png"))
+
+	_, err = NewOutputFormat("gif", 90, "")
+	assert.Error(t, err)
+	_, err = NewOutputFormat("jpeg", 101, "")
+	assert.Error(t, err)
+	_, err = NewOutputFormat("jpeg", 90, "white")
+	assert.Error(t, err)
+}
+
+func TestKeepsEncoding(t *testing.T) {
+	ctx := context.Background()
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	encode := func(options *webp.Options) []byte {
+		buf := new(bytes.Buffer)
+		require.NoError(t, webp.Encode(buf, img, options))
+		return buf.Bytes()
+	}
+	lossy, lossless := encode(&webp.Options{Quality: 90}), encode(&webp.Options{Lossless: true})
+	assert.False(t, losslessWebP(lossy))
+	assert.True(t, losslessWebP(lossless))
+	assert.False(t, losslessWebP([]byte("RIFF\x00\x00\x00\x00WEBPVP8L")))
+
+	format, err := NewOutputFormat("webp-lossless", 90, "")
+	require.NoError(t, err)
+	assert.False(t, format.keepsEncoding(lossy))
+	assert.True(t, format.keepsEncoding(lossless))
+	format, err = NewOutputFormat("webp", 90, "")
+	require.NoError(t, err)
+	assert.True(t, format.keepsEncoding(lossy))
+
+	// A single lossy source tile is re-encoded for lossless output
+	tileset := testTileset(t, "lossy", 256, 0, color.NRGBA{})
+	require.NoError(t, tileset.Backend.PutFile(ctx, "0/0/0.webp", bytes.NewBuffer(lossy)))
+	tileset.index = map[[3]int]string{{0, 0, 0}: "webp"}
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "webp"}
+	merger := &Merger{Format: &OutputFormat{Name: "webp-lossless"}}
+	content, err := merger.Merge(ctx, tile, []*TilesetDescriptor{tileset}, nil)
+	require.NoError(t, err)
+	assert.True(t, losslessWebP(content))
+	merger.Format = &OutputFormat{Name: "webp", Quality: 90}
+	content, err = merger.Merge(ctx, tile, []*TilesetDescriptor{tileset}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, lossy, content)
+}
@@ -1,10 +1,34 @@
 package main
 
 import (
+	"fmt"
 	"image"
+	"image/color"
+	"strconv"
+	"strings"
 )
 
+// analyzeAlpha reports whether a tile can be skipped because it has no fully
+// opaque pixel, and whether it has any pixel which isn't fully opaque.
 func analyzeAlpha(img image.Image) (bool, bool) {
+	b := img.Bounds()
+	if b.Empty() {
+		return true, false
+	}
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return analyzeAlphaPix(img.Pix, img.Stride, b.Dx()*4, b.Dy())
+	case *image.RGBA:
+		return analyzeAlphaPix(img.Pix, img.Stride, b.Dx()*4, b.Dy())
+	case *image.Paletted:
+		return analyzeAlphaPaletted(img)
+	case *image.Gray:
+		return false, false
+	}
+	return analyzeAlphaGeneric(img)
+}
+
+func analyzeAlphaGeneric(img image.Image) (bool, bool) {
 	skip := true
 	hasAlphaPixel := false
 	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
@@ -25,3 +49,131 @@ func analyzeAlpha(img image.Image) (bool, bool) {
 	}
 	return skip, hasAlphaPixel
 }
+
+// analyzeAlphaPix scans the alpha bytes of 4 byte per pixel images.
+func analyzeAlphaPix(pix []byte, stride int, width int, height int) (bool, bool) {
+	skip := true
+	hasAlphaPixel := false
+	for y := 0; y < height; y++ {
+		row := pix[y*stride : y*stride+width]
+		for i := 3; i < len(row); i += 4 {
+			if row[i] == 0xff {
+				skip = false
+			} else {
+				hasAlphaPixel = true
+			}
+			if !skip && hasAlphaPixel {
+				return skip, hasAlphaPixel
+			}
+		}
+	}
+	return skip, hasAlphaPixel
+}
+
+func analyzeAlphaPaletted(img *image.Paletted) (bool, bool) {
+	// Indices beyond the palette are opaque black, like the PNG decoder does
+	var opaque [256]bool
+	for i := range opaque {
+		opaque[i] = true
+	}
+	allOpaque := true
+	for i, c := range img.Palette {
+		if i >= len(opaque) {
+			break
+		}
+		_, _, _, a := c.RGBA()
+		opaque[i] = a == 0xffff
+		allOpaque = allOpaque && opaque[i]
+	}
+	if allOpaque {
+		return false, false
+	}
+
+	skip := true
+	hasAlphaPixel := false
+	width := img.Bounds().Dx()
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for _, index := range img.Pix[y*img.Stride : y*img.Stride+width] {
+			if opaque[index] {
+				skip = false
+			} else {
+				hasAlphaPixel = true
+			}
+			if !skip && hasAlphaPixel {
+				return skip, hasAlphaPixel
+			}
+		}
+	}
+	return skip, hasAlphaPixel
+}
+
+// noDataColor is a color key, pixels whose channels all differ by at most
+// tolerance from it are NODATA.
+type noDataColor struct {
+	color     color.NRGBA
+	tolerance int
+}
+
+// parseNoData parses a color key in the form RRGGBB[~tolerance].
+func parseNoData(spec string) (noDataColor, error) {
+	parts := strings.SplitN(spec, "~", 2)
+	var result noDataColor
+	if len(parts[0]) != 6 {
+		return result, fmt.Errorf("invalid nodata color %s, expected RRGGBB", parts[0])
+	}
+	rgb, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return result, fmt.Errorf("invalid nodata color %s, expected RRGGBB", parts[0])
+	}
+	result.color = color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}
+	if len(parts) == 2 {
+		result.tolerance, err = strconv.Atoi(parts[1])
+		if err != nil || result.tolerance < 0 || result.tolerance > 255 {
+			return result, fmt.Errorf("invalid nodata tolerance %s, expected 0-255", parts[1])
+		}
+	}
+	return result, nil
+}
+
+func (n noDataColor) matches(c color.NRGBA) bool {
+	return absDiff(c.R, n.color.R) <= n.tolerance &&
+		absDiff(c.G, n.color.G) <= n.tolerance &&
+		absDiff(c.B, n.color.B) <= n.tolerance
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// applyNoData makes all pixels matching the NODATA rules of a source fully
+// transparent, so they are treated like any other transparent pixel. img is
+// returned as-is if the source has no rules.
+func applyNoData(img image.Image, options SourceOptions) (image.Image, error) {
+	if len(options.NoData) == 0 && options.AlphaThreshold == 0 {
+		return img, nil
+	}
+	var key *noDataColor
+	if len(options.NoData) > 0 {
+		parsed, err := parseNoData(options.NoData)
+		if err != nil {
+			return nil, err
+		}
+		key = &parsed
+	}
+
+	b := img.Bounds()
+	result := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if int(c.A) < options.AlphaThreshold || (key != nil && c.A > 0 && key.matches(c)) {
+				c = color.NRGBA{}
+			}
+			result.SetNRGBA(x, y, c)
+		}
+	}
+	return result, nil
+}
@@ -41,3 +41,99 @@ func TestAnalyzeAlpha(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyNoData(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 0, G: 0, B: 0, A: 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 5, G: 3, B: 8, A: 0xff})
+	img.SetNRGBA(2, 0, color.NRGBA{R: 100, G: 50, B: 20, A: 0xff})
+	img.SetNRGBA(3, 0, color.NRGBA{R: 100, G: 50, B: 20, A: 0x10})
+
+	var testCases = []struct {
+		Options     SourceOptions
+		Transparent [4]bool
+	}{
+		{SourceOptions{}, [4]bool{false, false, false, false}},
+		{SourceOptions{NoData: "000000"}, [4]bool{true, false, false, false}},
+		{SourceOptions{NoData: "000000~10"}, [4]bool{true, true, false, false}},
+		{SourceOptions{AlphaThreshold: 0x20}, [4]bool{false, false, false, true}},
+		{SourceOptions{NoData: "643214", AlphaThreshold: 0x20}, [4]bool{false, false, true, true}},
+	}
+	for idx, tc := range testCases {
+		result, err := applyNoData(img, tc.Options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x := 0; x < 4; x++ {
+			_, _, _, a := result.At(x, 0).RGBA()
+			if (a == 0) != tc.Transparent[x] {
+				t.Errorf("Test Case %d: pixel %d transparent=%t (expecting %t)", idx+1, x, a == 0, tc.Transparent[x])
+			}
+		}
+	}
+
+	if _, err := parseNoData("00000"); err == nil {
+		t.Error("expected error for short color")
+	}
+	if _, err := parseNoData("000000~300"); err == nil {
+		t.Error("expected error for invalid tolerance")
+	}
+}
+
+// alphaTestImages returns images of all types with fast paths, each filled
+// with the given alpha values (repeated).
+func alphaTestImages(size int, alphas ...uint8) map[string]image.Image {
+	rect := image.Rect(0, 0, size, size)
+	nrgba, rgba, gray := image.NewNRGBA(rect), image.NewRGBA(rect), image.NewGray(rect)
+	palette := color.Palette{color.NRGBA{R: 0xff, A: 0xff}}
+	for _, a := range alphas {
+		palette = append(palette, color.NRGBA{G: 0xff, A: a})
+	}
+	paletted := image.NewPaletted(rect, palette)
+	for i := 0; i < size*size; i++ {
+		a := alphas[i%len(alphas)]
+		x, y := i%size, i/size
+		nrgba.SetNRGBA(x, y, color.NRGBA{R: 0xff, A: a})
+		rgba.SetRGBA(x, y, color.RGBA{R: a, A: a})
+		paletted.SetColorIndex(x, y, uint8(1+i%len(alphas)))
+	}
+	return map[string]image.Image{
+		"nrgba":    nrgba,
+		"rgba":     rgba,
+		"paletted": paletted,
+		"gray":     gray,
+		"subimage": nrgba.SubImage(image.Rect(1, 1, size-1, size-1)),
+	}
+}
+
+func TestAnalyzeAlphaFastPaths(t *testing.T) {
+	for _, alphas := range [][]uint8{{0xff}, {0}, {0x80}, {0xff, 0}, {0, 0, 0xff}, {0xfe, 0x10}} {
+		for name, img := range alphaTestImages(4, alphas...) {
+			skip, hasAlpha := analyzeAlpha(img)
+			expectedSkip, expectedHasAlpha := analyzeAlphaGeneric(img)
+			if skip != expectedSkip || hasAlpha != expectedHasAlpha {
+				t.Errorf("%s with alphas %v: skip=%t hasAlphaPixel=%t (expecting %t, %t)", name, alphas,
+					skip, hasAlpha, expectedSkip, expectedHasAlpha)
+			}
+		}
+	}
+	if skip, _ := analyzeAlpha(image.NewNRGBA(image.Rect(0, 0, 0, 0))); !skip {
+		t.Error("empty images should be skipped")
+	}
+}
+
+func BenchmarkAnalyzeAlpha(b *testing.B) {
+	// Fully opaque tiles are the worst case, every pixel has to be looked at
+	for name, img := range alphaTestImages(256, 0xff) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				analyzeAlpha(img)
+			}
+		})
+		b.Run(name+"-generic", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				analyzeAlphaGeneric(img)
+			}
+		})
+	}
+}
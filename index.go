@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Indexer finds the tiles to merge without listing whole tilesets: the
+// listings of the sources are merge-joined one {z}/{x}/ column at a time and
+// the tiles are streamed in order of zoom level, lowest first unless
+// HighZoomsFirst is set, then column and row unless Rows or Hilbert are set.
+// Only the listings of the current column (and of its ancestors, for
+// overzoomed sources) are held in memory.
+type Indexer struct {
+	// Sources in z-order, base layer first
+	Sources []*TilesetDescriptor
+	// Target is listed along with the sources if set, to tell which tiles it
+	// has already.
+	Target *TilesetDescriptor
+	// CarryOver also yields the tiles which only exist in Target (regardless
+	// of Region), to be merged from the target alone.
+	CarryOver bool
+	// MinZ and MaxZ limit the zoom levels of the tiles (-1 for no limit).
+	// Without MaxZ, overzoomed sources are upsampled down to the highest zoom
+	// level of the sources, or TargetMaxZ if it's higher.
+	MinZ       int
+	MaxZ       int
+	TargetMaxZ int
+	Region     *Region
+	// Format is the extension of the target tiles.
+	Format string
+	// BestEffort treats sources which can't be listed as empty instead of
+	// failing.
+	BestEffort bool
+	// Hilbert orders the tiles of a zoom level along a Hilbert curve in
+	// blocks of hilbertBlock x hilbertBlock tiles, see runBand.
+	Hilbert bool
+	// Rows orders the tiles of a zoom level by row, then column. As the
+	// listings come in columns, the tiles of the whole zoom level are held in
+	// memory.
+	Rows bool
+	// HighZoomsFirst streams the zoom levels from the highest to the lowest.
+	HighZoomsFirst bool
+}
+
+// hilbertBlock is the width of the blocks of tiles ordered along a Hilbert
+// curve, a power of two. The tiles of as many columns are held in memory.
+const hilbertBlock = 16
+
+// IndexedTile is a tile to merge.
+type IndexedTile struct {
+	Tile TileDescriptor
+	// The sources which cover the tile, base layer first. They only know
+	// about the tiles of the tile's column.
+	Sources []*TilesetDescriptor
+	// Exists reports whether Target has the tile, TargetFormat is the
+	// extension of its file then.
+	Exists       bool
+	TargetFormat string
+}
+
+// formatChange returns an error if the target has the tile in another format,
+// which would be left behind next to the merged tile.
+func (t IndexedTile) formatChange() error {
+	if !t.Exists || t.TargetFormat == t.Tile.Format {
+		return nil
+	}
+	return fmt.Errorf("%s exists in the target as .%s, changing the format in place would leave it behind (write to a new location with -o instead)", t.Tile, t.TargetFormat)
+}
+
+// column is the listing of a {z}/{x}/ directory: rows and their formats.
+type column struct {
+	z, x int
+	rows map[int]string
+}
+
+// indexedTileset is a tileset being merge-joined.
+type indexedTileset struct {
+	tileset *TilesetDescriptor
+	zooms   map[int]bool
+	// Columns on the zoom levels 0-overzoom above the current one
+	columns []map[int]bool
+	// Last listed column per level
+	listed []*column
+}
+
+// zoomLevels lists the zoom levels of a backend, in order.
+func zoomLevels(ctx context.Context, backend StorageBackend) ([]int, error) {
+	dirs, err := backend.GetDirectories(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var zooms []int
+	for _, dir := range dirs {
+		if z, err := strconv.Atoi(dir); err == nil && z >= 0 {
+			zooms = append(zooms, z)
+		}
+	}
+	sort.Ints(zooms)
+	return zooms, nil
+}
+
+func (ix *Indexer) open(ctx context.Context, tileset *TilesetDescriptor) (*indexedTileset, error) {
+	zooms, err := zoomLevels(ctx, tileset.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s: %w", tileset.Name, err)
+	}
+	t := &indexedTileset{
+		tileset: tileset,
+		zooms:   map[int]bool{},
+		columns: make([]map[int]bool, tileset.Options.Overzoom+1),
+		listed:  make([]*column, tileset.Options.Overzoom+1),
+	}
+	for _, z := range zooms {
+		t.zooms[z] = true
+	}
+	return t, nil
+}
+
+// listColumns lists the columns of zoom level z on all levels the tileset
+// may be upsampled from.
+func (t *indexedTileset) listColumns(ctx context.Context, z int) error {
+	for level := range t.columns {
+		t.columns[level] = nil
+		if level > z || !t.zooms[z-level] {
+			continue
+		}
+		dirs, err := t.tileset.Backend.GetDirectories(ctx, fmt.Sprintf("%d/", z-level))
+		if err != nil {
+			return err
+		}
+		t.columns[level] = map[int]bool{}
+		for _, dir := range dirs {
+			if x, err := strconv.Atoi(dir); err == nil {
+				t.columns[level][x] = true
+			}
+		}
+	}
+	return nil
+}
+
+// list returns the listing of column x on the given level above zoom level z,
+// nil if it doesn't exist.
+func (t *indexedTileset) list(ctx context.Context, level, z, x int) (*column, error) {
+	z, x = z-level, x>>uint(level)
+	if !t.columns[level][x] {
+		return nil, nil
+	}
+	if c := t.listed[level]; c != nil && c.z == z && c.x == x {
+		return c, nil
+	}
+	dir := fmt.Sprintf("%d/%d/", z, x)
+	files, err := t.tileset.Backend.GetFiles(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &column{z: z, x: x, rows: map[int]string{}}
+	for _, f := range files {
+		parts := strings.Split(f, ".")
+		if len(parts) != 2 {
+			continue
+		}
+		if y, err := strconv.Atoi(parts[0]); err == nil {
+			c.rows[y] = parts[1]
+		}
+	}
+	t.listed[level] = c
+	return c, nil
+}
+
+// Run streams the tiles to emit until all have been emitted or emit returns
+// false.
+func (ix *Indexer) Run(ctx context.Context, emit func(IndexedTile) bool) error {
+	var sources []*indexedTileset
+	for _, source := range ix.Sources {
+		t, err := ix.open(ctx, source)
+		if err != nil {
+			if !ix.BestEffort {
+				return err
+			}
+			log.Println(err)
+			continue
+		}
+		sources = append(sources, t)
+	}
+	var target *indexedTileset
+	if ix.Target != nil && ix.Target.Backend != nil {
+		var err error
+		target, err = ix.open(ctx, ix.Target)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The zoom levels of the result
+	maxZ := ix.MaxZ
+	if maxZ < 0 {
+		maxZ = ix.TargetMaxZ
+		for _, t := range sources {
+			for z := range t.zooms {
+				if z > maxZ {
+					maxZ = z
+				}
+			}
+		}
+	}
+	zooms := map[int]bool{}
+	for _, t := range sources {
+		for z := range t.zooms {
+			for level := 0; level <= t.tileset.Options.Overzoom && z+level <= maxZ; level++ {
+				if z+level >= ix.MinZ {
+					zooms[z+level] = true
+				}
+			}
+		}
+	}
+	if target != nil && ix.CarryOver {
+		for z := range target.zooms {
+			if z >= ix.MinZ && (ix.MaxZ < 0 || z <= ix.MaxZ) {
+				zooms[z] = true
+			}
+		}
+	}
+	var ordered []int
+	for z := range zooms {
+		ordered = append(ordered, z)
+	}
+	sort.Ints(ordered)
+	if ix.HighZoomsFirst {
+		sort.Sort(sort.Reverse(sort.IntSlice(ordered)))
+	}
+
+	for _, z := range ordered {
+		more, err := ix.runZoom(ctx, z, sources, target, emit)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// envelope returns the range of tiles of the region on zoom level z.
+func (ix *Indexer) envelope(z int) (tileRange, bool) {
+	if ix.Region == nil {
+		return tileRange{MinX: 0, MaxX: math.MaxInt32, MinY: 0, MaxY: math.MaxInt32}, true
+	}
+	return ix.Region.envelope(z)
+}
+
+// failed handles a source which couldn't be listed, returning the error if
+// the run can't go on.
+func (ix *Indexer) failed(t *indexedTileset, err error) error {
+	err = fmt.Errorf("could not list %s: %w", t.tileset.Name, err)
+	if !ix.BestEffort {
+		return err
+	}
+	log.Println(err)
+	return nil
+}
+
+func (ix *Indexer) runZoom(ctx context.Context, z int, sources []*indexedTileset, target *indexedTileset, emit func(IndexedTile) bool) (bool, error) {
+	env, inRegion := ix.envelope(z)
+	candidates := map[int]bool{}
+	if inRegion {
+		for _, t := range sources {
+			if err := t.listColumns(ctx, z); err != nil {
+				if err := ix.failed(t, err); err != nil {
+					return false, err
+				}
+			}
+			for level, columns := range t.columns {
+				for a := range columns {
+					for x := a << uint(level); x < (a+1)<<uint(level); x++ {
+						if x >= env.MinX && x <= env.MaxX {
+							candidates[x] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	if target != nil {
+		target.columns[0] = nil
+		if target.zooms[z] {
+			if err := target.listColumns(ctx, z); err != nil {
+				return false, fmt.Errorf("could not list target: %w", err)
+			}
+		}
+		if ix.CarryOver {
+			for x := range target.columns[0] {
+				candidates[x] = true
+			}
+		}
+	}
+	columns := make([]int, 0, len(candidates))
+	for x := range candidates {
+		columns = append(columns, x)
+	}
+	sort.Ints(columns)
+
+	if ix.Rows {
+		return ix.runBand(ctx, z, columns, env, inRegion, sources, target, rowOrder, emit)
+	}
+	if ix.Hilbert {
+		for len(columns) > 0 {
+			band := 1
+			for band < len(columns) && columns[band]/hilbertBlock == columns[0]/hilbertBlock {
+				band++
+			}
+			more, err := ix.runBand(ctx, z, columns[:band], env, inRegion, sources, target, hilbertOrder, emit)
+			if err != nil || !more {
+				return more, err
+			}
+			columns = columns[band:]
+		}
+		return true, nil
+	}
+	for _, x := range columns {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		more, err := ix.runColumn(ctx, z, x, env, inRegion, sources, target, emit)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+	return true, nil
+}
+
+// runBand emits the tiles of a band of columns in the order of their keys,
+// see rowOrder and hilbertOrder.
+func (ix *Indexer) runBand(ctx context.Context, z int, columns []int, env tileRange, inRegion bool, sources []*indexedTileset, target *indexedTileset, key func(TileDescriptor) (int, int), emit func(IndexedTile) bool) (bool, error) {
+	var band []IndexedTile
+	for _, x := range columns {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		_, err := ix.runColumn(ctx, z, x, env, inRegion, sources, target, func(indexed IndexedTile) bool {
+			band = append(band, indexed)
+			return true
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	sort.Slice(band, func(i, j int) bool {
+		bi, di := key(band[i].Tile)
+		bj, dj := key(band[j].Tile)
+		return bi < bj || bi == bj && di < dj
+	})
+	for _, indexed := range band {
+		if !emit(indexed) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// rowOrder orders tiles by row, then column.
+func rowOrder(tile TileDescriptor) (int, int) {
+	return tile.Y, tile.X
+}
+
+// hilbertOrder orders the tiles of a band of hilbertBlock columns along a
+// Hilbert curve through each block of hilbertBlock x hilbertBlock tiles, which
+// starts at the top left corner and ends at the bottom left one, so the curves
+// of the blocks down the band join up.
+func hilbertOrder(tile TileDescriptor) (int, int) {
+	return tile.Y / hilbertBlock, hilbertIndex(hilbertBlock, tile.Y%hilbertBlock, tile.X%hilbertBlock)
+}
+
+// hilbertIndex returns the distance of (x, y) along a Hilbert curve through
+// an n x n square (n a power of two) from (0, 0) to (n-1, 0).
+func hilbertIndex(n, x, y int) int {
+	d := 0
+	for s := n / 2; s > 0; s /= 2 {
+		rx, ry := 0, 0
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				x, y = n-1-x, n-1-y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+func (ix *Indexer) runColumn(ctx context.Context, z, x int, env tileRange, inRegion bool, sources []*indexedTileset, target *indexedTileset, emit func(IndexedTile) bool) (bool, error) {
+	rows := map[int]bool{}
+	// Every source only knows about the tiles of this column, so the
+	// tilesets handed out don't hold on to more
+	views := make([]*TilesetDescriptor, 0, len(sources))
+	if inRegion {
+		for _, t := range sources {
+			view := *t.tileset
+			view.Tiles = nil
+			view.index = map[[3]int]string{}
+			for level := range t.columns {
+				c, err := t.list(ctx, level, z, x)
+				if err != nil {
+					if err := ix.failed(t, err); err != nil {
+						return false, err
+					}
+					continue
+				}
+				if c == nil {
+					continue
+				}
+				for a, format := range c.rows {
+					view.index[[3]int{c.z, c.x, a}] = format
+					for y := a << uint(level); y < (a+1)<<uint(level); y++ {
+						if y >= env.MinY && y <= env.MaxY {
+							rows[y] = true
+						}
+					}
+				}
+			}
+			views = append(views, &view)
+		}
+	}
+	var existing *column
+	if target != nil {
+		var err error
+		existing, err = target.list(ctx, 0, z, x)
+		if err != nil {
+			return false, fmt.Errorf("could not list target: %w", err)
+		}
+		if existing != nil && ix.CarryOver {
+			for y := range existing.rows {
+				rows[y] = true
+			}
+		}
+	}
+	ordered := make([]int, 0, len(rows))
+	for y := range rows {
+		ordered = append(ordered, y)
+	}
+	sort.Ints(ordered)
+
+	for _, y := range ordered {
+		tile := TileDescriptor{Z: z, X: x, Y: y, Format: ix.Format}
+		indexed := IndexedTile{Tile: tile}
+		if ix.Region.Contains(z, x, y) {
+			for _, view := range views {
+				if _, ok := view.Resolve(tile); ok && view.Covers(tile) {
+					indexed.Sources = append(indexed.Sources, view)
+				}
+			}
+		}
+		if existing != nil {
+			indexed.TargetFormat, indexed.Exists = existing.rows[y]
+		}
+		if len(indexed.Sources) == 0 {
+			if !ix.CarryOver || !indexed.Exists {
+				continue
+			}
+			// Only in the target
+			view := *ix.Target
+			view.Tiles = nil
+			view.index = map[[3]int]string{{z, x, y}: existing.rows[y]}
+			indexed.Sources = []*TilesetDescriptor{&view}
+		}
+		if !emit(indexed) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+// testListing returns a tileset with empty files at the given paths.
+func testListing(t *testing.T, name string, files ...string) *TilesetDescriptor {
+	ctx := context.Background()
+	backend := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	for _, f := range files {
+		require.NoError(t, backend.MkdirAll(ctx, f[:strings.LastIndex(f, "/")+1]))
+		require.NoError(t, backend.PutFile(ctx, f, new(bytes.Buffer)))
+	}
+	return &TilesetDescriptor{Name: name, Backend: backend, Options: defaultSourceOptions()}
+}
+
+// runIndexer returns the tiles found, with their sources and whether they
+// exist.
+func runIndexer(t *testing.T, ix *Indexer) []string {
+	var result []string
+	err := ix.Run(context.Background(), func(indexed IndexedTile) bool {
+		entry := fmt.Sprintf("%s %s", indexed.Tile, strings.Join(sourceNames(indexed.Sources), "|"))
+		if indexed.Exists {
+			entry += " exists"
+		}
+		result = append(result, entry)
+		return true
+	})
+	require.NoError(t, err)
+	return result
+}
+
+func TestIndexer(t *testing.T) {
+	base := testListing(t, "base", "2/1/1.png", "2/1/2.jpg", "2/3/0.png", "1/0/0.png")
+	overlay := testListing(t, "overlay", "1/0/1.png", "2/1/2.png")
+	overlay.Options.Overzoom = 1
+	ix := &Indexer{Sources: []*TilesetDescriptor{base, overlay}, MinZ: -1, MaxZ: -1, TargetMaxZ: -1, Format: "webp"}
+
+	assert.Equal(t, []string{
+		"1/0/0.webp base",
+		"1/0/1.webp overlay",
+		"2/0/2.webp overlay",
+		"2/0/3.webp overlay",
+		"2/1/1.webp base",
+		"2/1/2.webp base|overlay",
+		"2/1/3.webp overlay",
+		"2/3/0.webp base",
+	}, runIndexer(t, ix))
+
+	// Sources only know about the column of the tile
+	err := ix.Run(context.Background(), func(indexed IndexedTile) bool {
+		if indexed.Tile.String() == "2/1/3.webp" {
+			tile, ok := indexed.Sources[0].Resolve(indexed.Tile)
+			assert.True(t, ok)
+			assert.Equal(t, "1/0/1.png", tile.String())
+			_, ok = indexed.Sources[0].Resolve(TileDescriptor{Z: 2, X: 3, Y: 0})
+			assert.False(t, ok)
+		}
+		if indexed.Tile.String() == "2/1/2.webp" {
+			tile, _ := indexed.Sources[0].Resolve(indexed.Tile)
+			assert.Equal(t, "jpg", tile.Format)
+		}
+		return true
+	})
+	require.NoError(t, err)
+
+	// Zoom levels and regions are honored, overzoomed sources are upsampled
+	// down to the highest zoom level of the target
+	region, err := NewRegion("", []string{"3/2-3/4-7"})
+	require.NoError(t, err)
+	ix = &Indexer{Sources: []*TilesetDescriptor{base, overlay}, MinZ: 2, MaxZ: -1, TargetMaxZ: 3, Region: region, Format: "png"}
+	assert.Equal(t, []string{
+		"3/2/4.png overlay",
+		"3/2/5.png overlay",
+		"3/3/4.png overlay",
+		"3/3/5.png overlay",
+	}, runIndexer(t, ix))
+}
+
+func TestIndexerTarget(t *testing.T) {
+	source := testListing(t, "source", "1/0/0.png", "1/1/1.png")
+	target := testListing(t, "target", "1/0/0.png", "1/0/1.png", "0/0/0.png")
+	region, err := NewRegion("", []string{"1/0-0/0-1"})
+	require.NoError(t, err)
+	ix := &Indexer{Sources: []*TilesetDescriptor{source}, Target: target, MinZ: -1, MaxZ: -1, TargetMaxZ: -1, Region: region, Format: "png"}
+	assert.Equal(t, []string{"1/0/0.png source exists"}, runIndexer(t, ix))
+
+	// Tiles of the target outside of the region are carried over as well
+	ix.CarryOver = true
+	assert.Equal(t, []string{
+		"0/0/0.png target exists",
+		"1/0/0.png source exists",
+		"1/0/1.png target exists",
+	}, runIndexer(t, ix))
+
+	// The run stops when asked to
+	count := 0
+	require.NoError(t, ix.Run(context.Background(), func(IndexedTile) bool {
+		count++
+		return false
+	}))
+	assert.Equal(t, 1, count)
+}
+
+func TestIndexerFormatChange(t *testing.T) {
+	source := testListing(t, "source", "1/0/0.png", "1/0/1.png", "1/1/0.png")
+	target := testListing(t, "target", "1/0/0.png", "1/0/1.webp")
+	ix := &Indexer{Sources: []*TilesetDescriptor{source}, Target: target, MinZ: -1, MaxZ: -1, TargetMaxZ: -1, Format: "webp"}
+
+	var changed []string
+	require.NoError(t, ix.Run(context.Background(), func(indexed IndexedTile) bool {
+		if err := indexed.formatChange(); err != nil {
+			assert.Contains(t, err.Error(), "-o")
+			changed = append(changed, indexed.Tile.String()+" "+indexed.TargetFormat)
+		}
+		return true
+	}))
+	// The existing .webp tile is simply overwritten, the new one isn't in the
+	// target at all
+	assert.Equal(t, []string{"1/0/0.webp png"}, changed)
+}
+
+func TestIndexerHilbert(t *testing.T) {
+	// Two bands of two blocks each on zoom level 5
+	var files []string
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			files = append(files, fmt.Sprintf("5/%d/%d.png", x, y))
+		}
+	}
+	source := testListing(t, "source", files...)
+	ix := &Indexer{Sources: []*TilesetDescriptor{source}, MinZ: -1, MaxZ: -1, TargetMaxZ: -1, Format: "png", Hilbert: true}
+
+	var tiles []TileDescriptor
+	require.NoError(t, ix.Run(context.Background(), func(indexed IndexedTile) bool {
+		tiles = append(tiles, indexed.Tile)
+		return true
+	}))
+	require.Len(t, tiles, 32*32)
+	seen := map[string]bool{}
+	for i, tile := range tiles {
+		seen[tile.String()] = true
+		// Each band is done before the next one
+		assert.Equal(t, i/(16*32), tile.X/16, tile.String())
+		if i%(16*32) == 0 {
+			assert.Equal(t, 0, tile.Y, tile.String())
+			continue
+		}
+		// and traversed in steps to a neighbouring tile
+		previous := tiles[i-1]
+		dx, dy := tile.X-previous.X, tile.Y-previous.Y
+		assert.Equal(t, 1, dx*dx+dy*dy, "%s after %s", tile, previous)
+	}
+	assert.Len(t, seen, 32*32)
+}
+
+func TestIndexerOrder(t *testing.T) {
+	source := testListing(t, "source", "0/0/0.png", "1/0/0.png", "1/0/1.png", "1/1/0.png", "1/1/1.png")
+	ix := &Indexer{Sources: []*TilesetDescriptor{source}, MinZ: -1, MaxZ: -1, TargetMaxZ: -1, Format: "png"}
+	assert.Equal(t, []string{
+		"0/0/0.png source",
+		"1/0/0.png source",
+		"1/0/1.png source",
+		"1/1/0.png source",
+		"1/1/1.png source",
+	}, runIndexer(t, ix))
+
+	// Row by row, highest zoom level first
+	ix.Rows = true
+	ix.HighZoomsFirst = true
+	assert.Equal(t, []string{
+		"1/0/0.png source",
+		"1/1/0.png source",
+		"1/0/1.png source",
+		"1/1/1.png source",
+		"0/0/0.png source",
+	}, runIndexer(t, ix))
+}
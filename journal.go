@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/v4lli/prioritile/MBTilesBackend"
+	"github.com/v4lli/prioritile/PMTilesBackend"
+)
+
+const journalName = ".prioritile-journal"
+
+// Journal is an append-only local file listing the tiles a run has finished,
+// so an interrupted run can be resumed. The first line identifies the run;
+// tiles are appended one per line as soon as they are done, a torn last line
+// is ignored.
+type Journal struct {
+	// Tiles finished by the previous run
+	Done map[string]bool
+
+	mu   sync.Mutex
+	file *os.File
+	path string
+}
+
+// journalLocation returns the local path of the journal of a target: in the
+// root of directory targets, next to archive files and in the working
+// directory for remote targets.
+func journalLocation(target StorageBackend, path string) string {
+	if len(path) > 0 {
+		return path
+	}
+	if fs, ok := localBackend(target); ok {
+		return filepath.Join(fs.BasePath, journalName)
+	}
+	switch b := baseBackend(target).(type) {
+	case *MBTilesBackend.MBTilesBackend:
+		return b.Path + journalName
+	case *PMTilesBackend.PMTilesBackend:
+		return b.Path + journalName
+	}
+	return journalName
+}
+
+// journalHeader identifies a run by its target, sources and output format, so
+// a journal isn't applied to a different merge.
+func journalHeader(target string, sources []string, format *OutputFormat) string {
+	key := strings.Join(append([]string{target, format.Name}, sources...), "\n")
+	return "# prioritile journal " + contentHash([]byte(key))
+}
+
+// OpenJournal starts a new journal at path. If resume is set, the tiles
+// recorded by the previous run with the same header are loaded and the
+// journal is continued instead.
+func OpenJournal(path string, header string, resume bool) (*Journal, error) {
+	j := &Journal{Done: map[string]bool{}, path: path}
+	if resume {
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			lines := strings.Split(string(content), "\n")
+			if lines[0] != header {
+				return nil, fmt.Errorf("journal %s belongs to a different merge", path)
+			}
+			// The last element is either empty or a torn line
+			for _, line := range lines[1 : len(lines)-1] {
+				j.Done[line] = true
+			}
+			j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, err
+			}
+			// Cut off a torn line, so the next tile starts on a line of its own
+			if err := j.file.Truncate(int64(len(content) - len(lines[len(lines)-1]))); err != nil {
+				j.file.Close()
+				return nil, err
+			}
+			return j, nil
+		}
+	}
+	var err error
+	j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := j.file.WriteString(header + "\n"); err != nil {
+		j.file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Finish records that tile is done. It must only be called once the tile has
+// been written to the target.
+func (j *Journal) Finish(tile string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// A single write per line, so lines of concurrent workers can't interleave
+	_, err := j.file.WriteString(tile + "\n")
+	return err
+}
+
+// Remove deletes the journal after a run has completed.
+func (j *Journal) Remove() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.path)
+}
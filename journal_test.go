@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	header := journalHeader("target", []string{"base", "overlay"}, DefaultOutputFormat)
+
+	j, err := OpenJournal(path, header, false)
+	require.NoError(t, err)
+	require.NoError(t, j.Finish("1/0/0.png"))
+	require.NoError(t, j.Finish("1/0/1.png"))
+	// A run killed in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("1/1/")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, err = OpenJournal(path, header, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"1/0/0.png": true, "1/0/1.png": true}, j.Done)
+	require.NoError(t, j.Finish("1/1/0.png"))
+
+	j, err = OpenJournal(path, header, true)
+	require.NoError(t, err)
+	assert.Len(t, j.Done, 3)
+	assert.True(t, j.Done["1/1/0.png"])
+
+	_, err = OpenJournal(path, journalHeader("target", []string{"base"}, DefaultOutputFormat), true)
+	assert.Error(t, err)
+
+	// Without resuming, the journal starts over
+	j, err = OpenJournal(path, header, false)
+	require.NoError(t, err)
+	j, err = OpenJournal(path, header, true)
+	require.NoError(t, err)
+	assert.Empty(t, j.Done)
+	require.NoError(t, j.Remove())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
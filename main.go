@@ -2,32 +2,50 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"image"
-	"image/draw"
-	"image/png"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	atomic "sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/v4lli/prioritile/FsBackend"
+	"github.com/v4lli/prioritile/MBTilesBackend"
+	"github.com/v4lli/prioritile/PMTilesBackend"
 	"github.com/v4lli/prioritile/S3Backend"
+	"golang.org/x/image/draw"
 )
 
 type StorageBackend interface {
-	GetDirectories(dirname string) ([]string, error)
-	GetFiles(dirname string) ([]string, error)
-	GetFilesRecursive(dirname string) ([]string, error)
-	MkdirAll(dirname string) error
-	GetFile(filename string) ([]byte, error)
-	PutFile(filename string, content *bytes.Buffer) error
-	FileExists(filename string) bool
+	GetDirectories(ctx context.Context, dirname string) ([]string, error)
+	GetFiles(ctx context.Context, dirname string) ([]string, error)
+	GetFilesRecursive(ctx context.Context, dirname string) ([]string, error)
+	MkdirAll(ctx context.Context, dirname string) error
+	GetFile(ctx context.Context, filename string) ([]byte, error)
+	PutFile(ctx context.Context, filename string, content *bytes.Buffer) error
+	FileExists(ctx context.Context, filename string) bool
+}
+
+// FinalizingBackend is implemented by backends which need to do some
+// bookkeeping once all tiles have been written (e.g. updating metadata).
+type FinalizingBackend interface {
+	Finalize() error
+}
+
+// WriteOnceBackend is implemented by backends which can't update tiles in
+// place (e.g. PMTiles archives). Every tile of the result has to be passed to
+// PutFile, the output is only assembled on Finalize.
+type WriteOnceBackend interface {
+	FinalizingBackend
+	WriteOnce() bool
 }
 
 type Job struct {
@@ -36,6 +54,34 @@ type Job struct {
 	tile    TileDescriptor
 }
 
+// composeJob is a tile whose source tiles have been fetched.
+type composeJob struct {
+	Job
+	fetched *FetchedTile
+}
+
+// uploadJob is an encoded tile waiting to be written to the target.
+type uploadJob struct {
+	Job
+	content []byte
+	// Versions of the source tiles, for the manifest
+	inputs map[string]string
+	// Unchanged tiles are only copied to a write-once target
+	unchanged bool
+}
+
+// stringList is a flag which can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func atomicAverage(target *int64, channel *chan time.Duration) {
 	// This is more fun than a locked section to take care about atomic stuff
 	for i := range *channel {
@@ -44,49 +90,209 @@ func atomicAverage(target *int64, channel *chan time.Duration) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+
 	numWorkers := flag.Int("parallel", 2, "Number of parallel threads to use for processing")
+	fetchParallel := flag.Int("fetch-parallel", 0, "Number of tiles whose source tiles are fetched concurrently (default: -parallel)")
+	composeParallel := flag.Int("compose-parallel", 0, "Number of tiles decoded, composited and encoded concurrently (default: -parallel)")
+	uploadParallel := flag.Int("upload-parallel", 0, "Number of tiles uploaded to the target concurrently (default: -parallel)")
 	quiet := flag.Bool("quiet", false, "Don't output progress information")
 	debug := flag.Bool("debug", false, "Enable debugging (tracing and some perf counters)")
 	report := flag.Bool("report", false, "Enable periodic reports (every min); intended for non-interactive environments")
 	bestEffort := flag.Bool("best-effort", false, "Best-effort merging: ignore erroneous tilesets completely and silently skip single failed tiles.")
 	zoom := flag.String("zoom", "", "Restrict/manually set zoom levels to work on, in the form of 'minZ-maxZ' (e.g. '1-8'). If this option is specified, prioritile does not try to automatically detect the zoom levels of the target but rather uses these hardcoded ones.")
 	timeout := flag.Int("timeout", 60, "Configure the timeout for S3 disk backend operations (timeout in seconds)")
+	retries := flag.Int("retries", 3, "Number of retries of backend operations which failed with a transient error (e.g. a timeout, a 503 or a locked MBTiles database), 0 to disable")
+	retryBackoff := flag.Duration("retry-backoff", 500*time.Millisecond, "Delay before the first retry, doubled with every further one (up to "+maxRetryBackoff.String()+")")
+	retryJitter := flag.Float64("retry-jitter", 0.5, "Randomize retry delays by up to this fraction (0-1)")
+	incremental := flag.Bool("incremental", false, "Keep a manifest of the inputs of every target tile and skip tiles whose inputs haven't changed since the last run")
+	force := flag.Bool("force", false, "With -incremental: rebuild all tiles regardless of the manifest (and write a fresh one)")
+	manifestPath := flag.String("manifest", "", "With -incremental: local path of the manifest file (default: "+manifestName+" in the target directory, or next to MBTiles/PMTiles targets)")
+	overviews := flag.Int("overviews", -1, "After merging, rebuild the parents of all changed tiles down to this zoom level by downsampling their four children, which keeps the list of changed tiles in memory (disabled if negative)")
+	overviewFilter := flag.String("overview-filter", "box", "Resampling filter for -overviews: "+interpolatorNames())
+	overzoomFilter := flag.String("overzoom-filter", "bilinear", "Resampling filter for upsampling tiles of overzoomed sources: "+interpolatorNames())
+	bbox := flag.String("bbox", "", "Only merge tiles touching this bounding box, in the form of 'minLon,minLat,maxLon,maxLat' (EPSG:4326)")
+	var ranges stringList
+	flag.Var(&ranges, "range", "Only merge tiles in this range, in the form of 'z/minX-maxX/minY-maxY' (e.g. '8/136-137/88-89'). Can be given multiple times; zoom levels without a range are skipped.")
+	format := flag.String("format", "png", "Output format of the merged tiles: png, jpeg, webp or webp-lossless (sources may be PNG, JPEG or WebP)")
+	quality := flag.Int("quality", 90, "Quality (0-100) for jpeg and webp output")
+	background := flag.String("background", "", "Color (RRGGBB) transparent pixels are painted onto for jpeg output; tiles with transparent pixels fail without it")
+	tileSize := flag.Int("tile-size", 0, "Size of the merged tiles in pixels (e.g. 256 or 512); layers of other sizes are resampled. If 0, the size of the largest layer of each tile is used.")
+	resampleFilter := flag.String("resample-filter", "bilinear", "Resampling filter for layers which don't match the tile size: "+interpolatorNames())
+	strictSize := flag.Bool("strict-size", false, "Fail on tiles whose layers don't match the tile size instead of resampling them")
+	resume := flag.Bool("resume", false, "Skip the tiles which an interrupted previous run with the same target and sources has finished, according to its journal")
+	journalPath := flag.String("journal", "", "Local path of the journal of finished tiles, which is kept until the run completes (default: "+journalName+" in the target directory, next to MBTiles/PMTiles targets or in the working directory)")
+	fsync := flag.Bool("fsync", false, "Flush every tile written to a local target to disk before renaming it into place, and its directory after (slower, but survives power loss)")
+	failureReport := flag.String("failure-report", "", "Write all per-tile failures (tile, source, stage and error) with a summary to this JSON file")
+	rerun := flag.String("rerun", "", "Only merge the tiles listed in this failure report of a previous run (see -failure-report)")
+	order := flag.String("order", "columns", "Order of the tiles within a zoom level: columns ({x}/ directories, then rows), rows (row by row, holding a whole zoom level in memory) or hilbert (along a Hilbert curve through blocks of 16x16 tiles)")
+	zoomOrder := flag.String("zoom-order", "low", "Order of the zoom levels: low (lowest first, so an interrupted run leaves a usable overview) or high (highest first)")
+	dryRun := flag.String("dry-run", "", "Only list the tilesets and print the plan (json or csv) to stdout, without fetching or writing any tile")
+	configPath := flag.String("config", "", "JSON file listing additional sources (with their options), which are stacked on top of the ones given as arguments")
+	output := flag.String("o", "", "Write the merged tiles to this location instead of the first tiles location. All positional arguments are then treated as read-only sources, starting with the base layer.")
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr, "Usage: prioritile [-zoom '1-8'] [-debug] [-report] [-best-effort] [-parallel=2] [-timeout=60] /tiles/target/ /tiles/source1/ [https://foo.com/tiles/source2/ [...]]")
+		fmt.Fprintln(os.Stderr, "Usage: prioritile [-zoom '1-8'] [-debug] [-report] [-best-effort] [-parallel=2 [-fetch-parallel=2] [-compose-parallel=2] [-upload-parallel=2]] [-timeout=60] [-retries=3] [-incremental [-force]] [-resume [-journal path]] [-overviews=0 [-overview-filter=box]] [-bbox minLon,minLat,maxLon,maxLat] [-range z/minX-maxX/minY-maxY] [-format=png [-quality=90] [-background=RRGGBB]] [-tile-size=256 [-resample-filter=bilinear] [-strict-size]] [-config sources.json] [-failure-report failures.json] [-rerun failures.json] [-order=columns|rows|hilbert] [-zoom-order=low|high] [-dry-run=json|csv] [-o /tiles/output/] /tiles/target/ /tiles/source1/ [https://foo.com/tiles/source2/ [...]]")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "prioritile applies a painter-type algorithm to the first tiles location specified")
 		fmt.Fprintln(os.Stderr, "on the commandline in an efficient way by leveraging the XYZ (and WMTS) directory ")
 		fmt.Fprintln(os.Stderr, "structure. All trailing tile source directives will be used by the algorithm, in the")
 		fmt.Fprintln(os.Stderr, "z-order specified. At least two (one base tileset + one overlay) source directives")
 		fmt.Fprintln(os.Stderr, "are required. The zoom levels of all files must be the same.")
+		fmt.Fprintln(os.Stderr, "With -o, the first tiles location is left untouched and the result is written to the")
+		fmt.Fprintln(os.Stderr, "output location instead; tiles which only exist in the base layer are copied as-is.")
+		fmt.Fprintln(os.Stderr, "Options can be appended to source directives, e.g. '/tiles/source1/#overzoom=2'.")
+		fmt.Fprintln(os.Stderr, "- overzoom=N: upsample missing tiles from ancestors up to N zoom levels above")
+		fmt.Fprintln(os.Stderr, "- opacity=0.5: paint the source with the given opacity (0-1)")
+		fmt.Fprintln(os.Stderr, "- blend=MODE: combine the source with the layers below using "+strings.Join(blendModes, ", "))
+		fmt.Fprintln(os.Stderr, "- nodata=RRGGBB[~T]: treat pixels of this color (each channel +-T) as NODATA")
+		fmt.Fprintln(os.Stderr, "- alpha-threshold=N: treat pixels with an alpha value below N (0-255) as NODATA")
+		fmt.Fprintln(os.Stderr, "- cutline=FILE: only use the source inside the polygons of a GeoJSON file (EPSG:4326)")
+		fmt.Fprintln(os.Stderr, "- scheme=SCHEME: tile layout, xyz (default), tms, quadkey or a template like '{z}/{y}/{x}.png'; layouts not starting with {z}/ (like quadkey) are listed as a whole and held in memory")
+		fmt.Fprintln(os.Stderr, "  (the only option which can also be set for the target)")
+		fmt.Fprintln(os.Stderr, "Sources can also be listed in a JSON file passed with -config, e.g.")
+		fmt.Fprintln(os.Stderr, `{"sources": [{"path": "/tiles/hillshade/", "opacity": 0.5, "blend": "multiply"}]}`)
 		fmt.Fprintln(os.Stderr, "Some assumptions about the source directories:")
-		fmt.Fprintln(os.Stderr, "- Tiles are RGBA PNGs")
-		fmt.Fprintln(os.Stderr, "- NODATA is represented by 100% alpha")
-		fmt.Fprintln(os.Stderr, "- Resolution of corresponding tiles matches")
+		fmt.Fprintln(os.Stderr, "- Tiles are PNGs, JPEGs or WebPs")
+		fmt.Fprintln(os.Stderr, "- NODATA is represented by 100% alpha (unless set with the nodata options)")
+		fmt.Fprintln(os.Stderr, "- Resolution of corresponding tiles matches (otherwise, layers are resampled, see -tile-size)")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "S3 disk backends are supported as source and target, e.g. 'https://example.com[:port]/foobucket/'.")
 		fmt.Fprintln(os.Stderr, "S3 authentication information is read from environment variables prefixed with the target hostname and bucketname:")
 		fmt.Fprintln(os.Stderr, "example.com[:port]_foobucket_ACCESS_KEY_ID, example.com[:port]_foobucket_SECRET_ACCESS_KEY")
 		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "MBTiles files are supported as source and target, e.g. 'foo.mbtiles' or 'mbtiles:///data/foo'.")
+		fmt.Fprintln(os.Stderr, "PMTiles v3 archives are supported as source and target, e.g. 'foo.pmtiles' or 'pmtiles:///data/foo'.")
+		fmt.Fprintln(os.Stderr, "A PMTiles target can't be updated in place, a new archive replaces it once all tiles have been merged.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Run 'prioritile serve' to preview a merge through an on-the-fly merging tile server.")
+		fmt.Fprintln(os.Stderr, "")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	if flag.NArg() < 2 {
+	var configSources []SourceSpec
+	if len(*configPath) > 0 {
+		var err error
+		configSources, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, parallel := range []*int{fetchParallel, composeParallel, uploadParallel} {
+		if *parallel <= 0 {
+			*parallel = *numWorkers
+		}
+	}
+	numSources := flag.NArg() + len(configSources)
+	if (len(*output) == 0 && (flag.NArg() < 1 || numSources < 2)) || numSources < 1 {
 		flag.Usage()
 		return
 	}
 
+	// The first signal stops handing out tiles, the ones in progress are still
+	// finished. The second one cancels all backend operations right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopping := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Interrupted, finishing the tiles in progress (interrupt again to abort)...")
+		close(stopping)
+		<-signals
+		log.Println("Aborting...")
+		cancel()
+	}()
+	interrupted := func() bool {
+		select {
+		case <-stopping:
+			return true
+		default:
+			return false
+		}
+	}
+
 	if !*quiet {
 		log.Println("Discovering tilesets...")
 	}
 
-	targetBackend, err := stringToBackend(flag.Args()[0], false, *timeout)
+	// Without -o, the base layer is merged in place: it is the target but not
+	// one of the sources.
+	targetSpec := *output
+	sourceArgs := flag.Args()
+	if len(*output) == 0 {
+		targetSpec = flag.Args()[0]
+		sourceArgs = flag.Args()[1:]
+	}
+	sourceSpecs, err := parseSourceSpecs(sourceArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sourceSpecs = append(sourceSpecs, configSources...)
+
+	region, err := NewRegion(*bbox, ranges)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outFormat, err := NewOutputFormat(*format, *quality, *background)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The target only takes the scheme option
+	parsedTarget, err := parseSourceSpec(targetSpec)
 	if err != nil {
+		log.Fatal(err)
+	}
+	targetOptions := parsedTarget.SourceOptions
+	targetOptions.Scheme = defaultSourceOptions().Scheme
+	if targetOptions != defaultSourceOptions() {
+		log.Fatalf("only the scheme option can be set for the target %s", targetSpec)
+	}
+	if len(*dryRun) > 0 && *dryRun != "json" && *dryRun != "csv" {
+		log.Fatalf("invalid plan format %s, expected json or csv", *dryRun)
+	}
+	if *order != "columns" && *order != "rows" && *order != "hilbert" {
+		log.Fatalf("invalid order %s, expected columns, rows or hilbert", *order)
+	}
+	if *zoomOrder != "low" && *zoomOrder != "high" {
+		log.Fatalf("invalid zoom order %s, expected low or high", *zoomOrder)
+	}
+	if *retries < 0 || *retryJitter < 0 || *retryJitter > 1 {
+		log.Fatal("retries must not be negative and retry-jitter must be between 0 and 1")
+	}
+	retry := &RetryPolicy{Attempts: *retries, Backoff: *retryBackoff, MaxBackoff: maxRetryBackoff, Jitter: *retryJitter}
+	// A dry run must not create the target
+	targetBackend, err := stringToBackend(parsedTarget.Path, len(*dryRun) > 0, *timeout, retry)
+	if err != nil && len(*dryRun) > 0 && len(*output) > 0 {
+		log.Printf("could not open target (%v), planning as if it was empty", err)
+	} else if err != nil {
 		log.Fatalf("problem with backend: %s", err)
+	} else {
+		targetBackend, err = withScheme(targetBackend, parsedTarget.Scheme)
+		if err != nil {
+			log.Fatalf("problem with backend: %s", err)
+		}
+	}
+
+	// Clean up after interrupted writes of previous runs
+	if fs, ok := localBackend(targetBackend); ok && len(*dryRun) == 0 {
+		fs.Sync = *fsync
+		removed, err := fs.CleanTempFiles()
+		if err != nil {
+			log.Fatalf("could not clean up target: %v", err)
+		}
+		if removed > 0 && !*quiet {
+			log.Printf("Removed %d temporary files of an interrupted run\n", removed)
+		}
 	}
 
 	var target TilesetDescriptor
+	targetMaxZ := -1
 	if len(*zoom) > 0 {
 		parts := strings.Split(*zoom, "-")
 		minZ, err := strconv.Atoi(parts[0])
@@ -105,47 +311,160 @@ func main() {
 			MaxZ:    maxZ,
 			Backend: targetBackend,
 		}
+	} else if len(*output) > 0 {
+		// The output is overwritten, not merged into
+		target = TilesetDescriptor{
+			MinZ:    -1,
+			MaxZ:    -1,
+			Backend: targetBackend,
+		}
 	} else {
-		target, err = discoverTileset(targetBackend, -1, -1)
+		// Overzoomed sources are upsampled down to the highest zoom level of
+		// the target, too
+		target = TilesetDescriptor{
+			MinZ:    -1,
+			MaxZ:    -1,
+			Backend: targetBackend,
+		}
+		zooms, err := zoomLevels(ctx, targetBackend)
 		if err != nil && !*bestEffort {
 			log.Fatalf("could not discover target tileset: %v. Use -zoom flags to specify target range.", err)
 		}
+		if len(zooms) > 0 {
+			targetMaxZ = zooms[len(zooms)-1]
+		}
 	}
 
-	sources, errs := discoverTilesets(flag.Args()[1:], target, *bestEffort, *timeout)
+	target.Name = targetSpec
+	target.Options = defaultSourceOptions()
+
+	opened, errs := openTilesets(sourceSpecs, *timeout, retry)
 	if errs != nil && !*bestEffort {
 		log.Fatalf("could not discover tilesets: %v", errs)
 	}
+	sources := tilesetPointers(opened)
 
-	tilesDb := make(map[string][]*TilesetDescriptor)
-	var indexingBar *progressbar.ProgressBar
-	// composite-key hashmap; could be replaced with some fancy tree in the future, if necessary
-	if !*quiet {
-		log.Println("Indexing source directories and creating target structure...")
-		indexingBar = progressbar.Default(int64(len(sources)))
+	// Tiles which only exist in the base layer are copied over unchanged.
+	var base *TilesetDescriptor
+	writeOnce := false
+	if b, ok := baseBackend(target.Backend).(WriteOnceBackend); ok {
+		writeOnce = b.WriteOnce()
+	}
+	if len(*output) > 0 {
+		if len(sources) == 0 {
+			log.Fatal("no usable source tilesets")
+		}
+		base = sources[0]
+	} else if writeOnce {
+		base = &target
+	}
+
+	// The tiles are found while merging, see Indexer
+	indexer := &Indexer{
+		Sources:        sources,
+		MinZ:           target.MinZ,
+		MaxZ:           target.MaxZ,
+		TargetMaxZ:     targetMaxZ,
+		Region:         region,
+		Format:         outFormat.Ext(),
+		BestEffort:     *bestEffort,
+		Hilbert:        *order == "hilbert",
+		Rows:           *order == "rows",
+		HighZoomsFirst: *zoomOrder == "high",
+	}
+	if len(*output) == 0 && writeOnce {
+		// Write-once targets are rewritten from scratch, so tiles which only
+		// exist in the target have to be carried over as well (including
+		// the ones outside of the region).
+		indexer.Target = &target
+		indexer.CarryOver = true
+	} else if len(*output) == 0 || len(*dryRun) > 0 {
+		// In place, the tiles of the target have to be in the output
+		// format already, see formatChange
+		indexer.Target = &target
 	}
-	for idx, tileset := range sources {
+
+	var rerunTiles map[string]bool
+	if len(*rerun) > 0 {
+		if writeOnce {
+			log.Fatal("re-running failed tiles isn't supported for write-once targets")
+		}
+		previous, err := LoadFailureReport(*rerun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rerunTiles = map[string]bool{}
+		for _, key := range previous.Tiles() {
+			rerunTiles[key] = true
+		}
 		if !*quiet {
-			indexingBar.Add(1)
+			log.Printf("Re-running %d failed tiles\n", len(rerunTiles))
 		}
-		for _, tile := range tileset.GetTiles() {
-			if have, ok := tilesDb[tile.String()]; ok {
-				tilesDb[tile.String()] = append(have, &sources[idx])
-			} else {
-				tilesDb[tile.String()] = []*TilesetDescriptor{&sources[idx]}
-			}
-			err := target.Backend.MkdirAll(fmt.Sprintf("%d/%d/", tile.Z, tile.X))
-			if err != nil {
-				log.Fatal(err)
-			}
+	}
+
+	if len(*dryRun) > 0 {
+		writePlan(ctx, *dryRun, indexer, rerunTiles, *quiet)
+		return
+	}
+
+	upsampleFilter, err := parseInterpolator(*overzoomFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sizeFilter, err := parseInterpolator(*resampleFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *tileSize < 0 {
+		log.Fatal("tile-size must not be negative")
+	}
+	var filter draw.Interpolator
+	if *overviews >= 0 {
+		filter, err = parseInterpolator(*overviewFilter)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
+	var manifest *Manifest
+	if *incremental {
+		manifestBackend, manifestFile := manifestLocation(target.Backend, *manifestPath)
+		manifest, err = LoadManifest(ctx, manifestBackend, manifestFile)
+		if err != nil {
+			log.Fatalf("could not load manifest: %v", err)
+		}
+		manifest.Force = *force
+	}
+
+	// Write-once targets are only written when the run completes, so there
+	// is nothing to resume
+	var journal *Journal
+	if writeOnce && *resume {
+		log.Fatal("resuming isn't supported for write-once targets")
+	} else if !writeOnce {
+		header := journalHeader(target.Name, sourceNames(sources), outFormat)
+		journal, err = OpenJournal(journalLocation(target.Backend, *journalPath), header, *resume)
+		if err != nil {
+			log.Fatalf("could not open journal: %v", err)
+		}
+	}
+	if journal != nil && len(journal.Done) > 0 && !*quiet {
+		log.Printf("Resuming: %d tiles have already been merged\n", len(journal.Done))
+	}
+
 	// XXX check if input and output are both RGBA
 	// XXX check all tiles resolutions to match
 	var bar *progressbar.ProgressBar
 
 	// Performance measurement setup
+	var memStart runtime.MemStats
+	if *debug {
+		runtime.ReadMemStats(&memStart)
+	}
+	mergeStart := time.Now()
+	counterFetch := make(chan time.Duration, 1024)
+	var counterFetchNS int64
+	go atomicAverage(&counterFetchNS, &counterFetch)
 	counterBackwardsIteration := make(chan time.Duration, 1024)
 	var counterBackwardsIterationDurationNS int64
 	go atomicAverage(&counterBackwardsIterationDurationNS, &counterBackwardsIteration)
@@ -161,159 +480,439 @@ func main() {
 	counterEncode := make(chan time.Duration, 1024)
 	var counterEncodeNS int64
 	go atomicAverage(&counterEncodeNS, &counterEncode)
+	counterUpload := make(chan time.Duration, 1024)
+	var counterUploadNS int64
+	go atomicAverage(&counterUploadNS, &counterUpload)
+
+	failures := &FailureReport{Retry: retry}
+	merger := &Merger{
+		BestEffort:     *bestEffort,
+		Failures:       failures,
+		OverzoomFilter: upsampleFilter,
+		Format:         outFormat,
+		TileSize:       *tileSize,
+		ResampleFilter: sizeFilter,
+		StrictSize:     *strictSize,
+		Counters: perfCounters{
+			fetch:              counterFetch,
+			backwardsIteration: counterBackwardsIteration,
+			opaquenessCheck:    counterOpaquenessCheck,
+			alphaCheck:         counterAlphaCheck,
+			draw:               counterDraw,
+			encode:             counterEncode,
+		},
+	}
+	if len(*output) == 0 {
+		merger.Target = target.Backend
+	}
 
-	var wg sync.WaitGroup
 	jobChan := make(chan Job, 128)
 	var iterationCounter int32
-	for i := 0; i < *numWorkers; i++ {
-		wg.Add(1)
+	var skippedCounter int32
+	// Tiles written in this run (or the interrupted one), for building
+	// overviews. Only collected with -overviews, as this holds all of them in
+	// memory.
+	collectChanged := *overviews >= 0
+	var changed []TileDescriptor
+	var resumed []TileDescriptor
+	var changedMu sync.Mutex
+	// fail records a failed tile. It returns false if the run can't go on.
+	fail := func(tile TileDescriptor, stage string, err error) bool {
+		if ctx.Err() != nil {
+			// Aborted, not failed
+			return true
+		}
+		failures.Add(tile, stage, err)
+		if *bestEffort {
+			log.Println(err)
+			return true
+		}
+		if len(*failureReport) > 0 {
+			if err := failures.Save(*failureReport); err != nil {
+				log.Printf("could not save failure report: %v", err)
+			}
+		}
+		return false
+	}
+	var finishedCounter int32
+	finish := func(tile TileDescriptor) {
+		atomic.AddInt32(&finishedCounter, 1)
+		if journal == nil {
+			return
+		}
+		if err := journal.Finish(tile.String()); err != nil {
+			log.Fatalf("could not write journal: %v", err)
+		}
+	}
+	// Tiles pass three stages with their own workers: fetching the source
+	// tiles, composing and encoding the result and uploading it.
+	composeChan := make(chan composeJob, *composeParallel)
+	uploadChan := make(chan uploadJob, *uploadParallel)
+	var fetchWg, composeWg, uploadWg sync.WaitGroup
+	for i := 0; i < *fetchParallel; i++ {
+		fetchWg.Add(1)
 		go func(jobChan <-chan Job) {
-			defer wg.Done()
+			defer fetchWg.Done()
 			for job := range jobChan {
+				if interrupted() {
+					// Drain the queue
+					continue
+				}
 				if !*quiet {
 					bar.Add(1)
 				}
 
-				// iterate sources backwards (until fully opaque tile has been found), then merge all up to that one
-				var toMerge []*image.Image
-				opaque := false
-				startBackwardsIteration := time.Now()
-				for i := len(job.sources) - 1; i >= 0; i-- {
-					backend := job.sources[i].Backend
-					f, err := backend.GetFile(job.tile.String())
-					if err != nil {
-						if *bestEffort {
-							log.Println(err)
-							continue
-						} else {
-							log.Println("Failed to get " + job.tile.String())
-							log.Fatal(err)
+				if manifest != nil && manifest.Unchanged(ctx, job.tile, job.sources, target.Backend) {
+					if writeOnce {
+						// The new archive still needs the tile
+						f, err := target.Backend.GetFile(ctx, job.tile.String())
+						if err != nil {
+							if fail(job.tile, stageFetch, err) {
+								continue
+							} else {
+								log.Println("Failed to copy " + job.tile.String())
+								log.Fatal(err)
+							}
 						}
+						uploadChan <- uploadJob{Job: job, content: f, unchanged: true}
+						continue
+					}
+					atomic.AddInt32(&skippedCounter, 1)
+					finish(job.tile)
+					continue
+				}
+
+				// Tiles which only exist in the base layer and are already in the
+				// output format are carried over unchanged
+				copyBase := false
+				var baseTile TileDescriptor
+				if base != nil && len(job.sources) == 1 && job.sources[0].Name == base.Name {
+					var ok bool
+					baseTile, ok = job.sources[0].Resolve(job.tile)
+					copyBase = ok && baseTile.Z == job.tile.Z && base.Options.Unmodified() && outFormat.sameFormat(baseTile.Format)
+				}
+				var baseContent []byte
+				var baseErr error
+				if copyBase {
+					baseContent, baseErr = base.Backend.GetFile(ctx, baseTile.String())
+					// Tiles of another size are resampled and lossy WebP tiles
+					// re-encoded by merging them
+					copyBase = baseErr != nil || merger.FitsTileSize(baseContent) && outFormat.keepsEncoding(baseContent)
+				}
+				if copyBase {
+					f, err := baseContent, baseErr
+					var inputs map[string]string
+					if err != nil {
+						err = &TileError{job.tile, base.Name, stageFetch, err}
+					} else if manifest != nil {
+						var version string
+						version, err = fileVersion(ctx, base.Backend, baseTile.String(), f)
+						inputs = map[string]string{base.Name: version}
 					}
-					img, _, err := image.Decode(bytes.NewBuffer(f))
 					if err != nil {
-						if *bestEffort {
-							log.Println(err)
+						if fail(job.tile, stageFetch, err) {
 							continue
 						} else {
-							log.Println("Failed to decode " + job.tile.String())
+							log.Println("Failed to copy " + job.tile.String())
 							log.Fatal(err)
 						}
 					}
-
-					counterAlphaCheckStart := time.Now()
-					skip, hasAlphaPixel := analyzeAlpha(img)
-					counterAlphaCheck <- time.Since(counterAlphaCheckStart)
-					if skip {
-						continue
-					}
-					toMerge = append([]*image.Image{&img}, toMerge...)
-					if !hasAlphaPixel {
-						opaque = true
-						break
-					}
+					uploadChan <- uploadJob{Job: job, content: f, inputs: inputs}
+					continue
 				}
-				counterBackwardsIteration <- time.Since(startBackwardsIteration)
 
-				counterOpaquenessCheckStart := time.Now()
-				if !opaque {
-					targetF, err := target.Backend.GetFile(job.tile.String())
-					if err == nil {
-						img, _, err := image.Decode(bytes.NewBuffer(targetF))
-						if err != nil {
-							if *bestEffort {
-								log.Println(err)
-								continue
-							} else {
-								log.Println("Failed to decode " + job.tile.String())
-								log.Fatal(err)
-							}
-						}
-						toMerge = append([]*image.Image{&img}, toMerge...)
+				fetched, err := merger.Fetch(ctx, job.tile, job.sources, manifest != nil)
+				if err != nil {
+					if fail(job.tile, stageFetch, err) {
+						continue
+					} else {
+						log.Fatal(err)
 					}
 				}
-				counterOpaquenessCheck <- time.Since(counterOpaquenessCheckStart)
-				if len(toMerge) < 1 {
-					continue
-				}
-
-				counterDrawStart := time.Now()
-				merged := image.NewRGBA(image.Rect(0, 0, (*toMerge[0]).Bounds().Max.X, (*toMerge[0]).Bounds().Max.Y))
-				for _, img := range toMerge {
-					canvas := image.NewRGBA(image.Rect(0, 0, (*merged).Bounds().Max.X, (*merged).Bounds().Max.Y))
-					draw.Draw(canvas, (*merged).Bounds(), merged, image.Point{0, 0}, draw.Over)
-					draw.Draw(canvas, (*img).Bounds(), *img, image.Point{0, 0}, draw.Over)
-					merged = canvas
+				composeChan <- composeJob{job, fetched}
+			}
+		}(jobChan)
+	}
+	for i := 0; i < *composeParallel; i++ {
+		composeWg.Add(1)
+		go func() {
+			defer composeWg.Done()
+			for job := range composeChan {
+				var inputs map[string]string
+				if manifest != nil {
+					inputs = map[string]string{}
 				}
-				counterDraw <- time.Since(counterDrawStart)
-
-				counterEncodeStart := time.Now()
-				buf := new(bytes.Buffer)
-				if err := png.Encode(buf, merged); err != nil {
-					if *bestEffort {
-						log.Println(err)
+				content, err := merger.Compose(ctx, job.fetched, inputs)
+				if err != nil {
+					if fail(job.tile, stageCompose, err) {
 						continue
 					} else {
-						log.Println("Failed to encode " + job.tile.String())
 						log.Fatal(err)
 					}
 				}
-				if err := target.Backend.PutFile(job.tile.String(), buf); err != nil {
-					if *bestEffort {
-						log.Println(err)
+				if content == nil {
+					finish(job.tile)
+					continue
+				}
+				uploadChan <- uploadJob{Job: job.Job, content: content, inputs: inputs}
+			}
+		}()
+	}
+	for i := 0; i < *uploadParallel; i++ {
+		uploadWg.Add(1)
+		go func() {
+			defer uploadWg.Done()
+			for job := range uploadChan {
+				counterUploadStart := time.Now()
+				if err := target.Backend.PutFile(ctx, job.tile.String(), bytes.NewBuffer(job.content)); err != nil {
+					if fail(job.tile, stageUpload, err) {
 						continue
 					} else {
 						log.Println("Failed to upload " + job.tile.String())
 						log.Fatal(err)
 					}
 				}
-				counterEncode <- time.Since(counterEncodeStart)
+				counterUpload <- time.Since(counterUploadStart)
+				if job.unchanged {
+					atomic.AddInt32(&skippedCounter, 1)
+					finish(job.tile)
+					continue
+				}
+				if manifest != nil {
+					if err := manifest.Record(ctx, job.tile.String(), job.sources, job.inputs, target.Backend, job.content); err != nil {
+						log.Println(err)
+					}
+				}
+				finish(job.tile)
 				atomic.AddInt32(&iterationCounter, 1)
+				if collectChanged {
+					changedMu.Lock()
+					changed = append(changed, job.tile)
+					changedMu.Unlock()
+				}
 			}
-		}(jobChan)
+		}()
 	}
 
 	if !*quiet {
-		bar = progressbar.Default(int64(len(tilesDb)))
+		// The number of tiles isn't known before all of them have been found
+		bar = progressbar.Default(-1)
 	}
 
+	var dispatchedCounter int32
 	if *report {
 		go func() {
-			log.Printf("Progress: %d of %d total\n", iterationCounter, len(tilesDb))
-			time.Sleep(60 * time.Second)
+			for {
+				log.Printf("Progress: %d of %d found so far\n", atomic.LoadInt32(&iterationCounter), atomic.LoadInt32(&dispatchedCounter))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(60 * time.Second):
+				}
+			}
 		}()
 	}
 
-	for key, value := range tilesDb {
-		tile, err := Str2Tile(key)
-		if err != nil {
-			log.Fatal(err)
+	// The columns created on the current zoom level
+	columns := map[int]bool{}
+	lastZ := -1
+	err = indexer.Run(ctx, func(indexed IndexedTile) bool {
+		key := indexed.Tile.String()
+		if rerunTiles != nil && !rerunTiles[key] {
+			return true
 		}
-		jobChan <- Job{
-			sources: value,
+		if journal != nil && journal.Done[key] {
+			if collectChanged {
+				resumed = append(resumed, indexed.Tile)
+			}
+			return true
+		}
+		if err := indexed.formatChange(); err != nil && !writeOnce {
+			if !fail(indexed.Tile, stageFetch, err) {
+				log.Fatal(err)
+			}
+			return true
+		}
+		if indexed.Tile.Z != lastZ {
+			columns = map[int]bool{}
+			lastZ = indexed.Tile.Z
+		}
+		if !columns[indexed.Tile.X] {
+			if err := target.Backend.MkdirAll(ctx, fmt.Sprintf("%d/%d/", indexed.Tile.Z, indexed.Tile.X)); err != nil {
+				log.Fatal(err)
+			}
+			columns[indexed.Tile.X] = true
+		}
+		select {
+		case jobChan <- Job{
+			sources: indexed.Sources,
 			target:  target,
-			tile:    *tile,
+			tile:    indexed.Tile,
+		}:
+			atomic.AddInt32(&dispatchedCounter, 1)
+			return true
+		case <-stopping:
+			return false
 		}
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("could not index tilesets: %v", err)
 	}
 
 	close(jobChan)
-	wg.Wait()
+	fetchWg.Wait()
+	close(composeChan)
+	composeWg.Wait()
+	close(uploadChan)
+	uploadWg.Wait()
+	changed = append(changed, resumed...)
+	mergeDuration := time.Since(mergeStart)
+	var memEnd runtime.MemStats
 	if *debug {
+		runtime.ReadMemStats(&memEnd)
+	}
+	if len(*failureReport) > 0 {
+		if err := failures.Save(*failureReport); err != nil {
+			log.Printf("could not save failure report: %v", err)
+		}
+	}
+	if failed := failures.Tiles(); len(failed) > 0 && !*quiet {
+		log.Printf("%d tiles failed\n", len(failed))
+	}
+	if interrupted() {
+		if manifest != nil && ctx.Err() == nil {
+			if err := manifest.Save(ctx); err != nil {
+				log.Printf("could not save manifest: %v", err)
+			}
+		}
+		log.Printf("Stopped after %d of %d tiles found so far (%d merged or copied, %d unchanged, %d retried backend operations)\n",
+			finishedCounter, dispatchedCounter, iterationCounter, skippedCounter, retry.Retries())
+		if journal != nil {
+			log.Println("Run again with -resume to merge the remaining tiles")
+		} else if writeOnce {
+			log.Println("The target has been left untouched")
+		}
+		os.Exit(1)
+	}
+	if *overviews >= 0 {
+		if !*quiet {
+			log.Println("Building overviews...")
+		}
+		built, err := buildOverviews(ctx, target.Backend, changed, *overviews, filter, outFormat, *numWorkers, *bestEffort)
+		if err != nil {
+			log.Fatalf("could not build overviews: %v", err)
+		}
+		if !*quiet {
+			log.Printf("Built %d overview tiles\n", built)
+		}
+	}
+	if finalizer, ok := baseBackend(target.Backend).(FinalizingBackend); ok {
+		if err := finalizer.Finalize(); err != nil {
+			log.Fatalf("could not finalize target: %v", err)
+		}
+	}
+	if manifest != nil {
+		if err := manifest.Save(ctx); err != nil {
+			log.Fatalf("could not save manifest: %v", err)
+		}
+		if !*quiet {
+			log.Printf("Skipped %d unchanged tiles\n", skippedCounter)
+		}
+	}
+	if retry.Retries() > 0 && !*quiet {
+		log.Printf("Retried %d backend operations\n", retry.Retries())
+	}
+	if journal != nil {
+		if err := journal.Remove(); err != nil {
+			log.Printf("could not remove journal: %v", err)
+		}
+	}
+	if *debug {
+		fmt.Printf("Average Fetch: %s\n", time.Duration(counterFetchNS/1000/1000))
 		fmt.Printf("Average Backwards Iteration: %s\n", time.Duration(counterBackwardsIterationDurationNS/1000/1000))
 		fmt.Printf("Average Opaqueness Check: %s\n", time.Duration(counterOpaquenessCheckNS/1000/1000))
 		fmt.Printf("\\_Average Alpa Check: %s\n", time.Duration(counterAlphaCheckNS/1000/1000))
 		fmt.Printf("Average Draw: %s\n", time.Duration(counterDrawNS/1000/1000))
 		fmt.Printf("Average Encode: %s\n", time.Duration(counterEncodeNS/1000/1000))
+		fmt.Printf("Average Upload: %s\n", time.Duration(counterUploadNS/1000/1000))
+		fmt.Printf("Throughput: %.1f tiles/s (%d tiles in %s)\n",
+			float64(finishedCounter)/mergeDuration.Seconds(), finishedCounter, mergeDuration.Round(time.Millisecond))
+		if finishedCounter > 0 {
+			fmt.Printf("Allocated per tile: %d KiB in %d objects\n",
+				(memEnd.TotalAlloc-memStart.TotalAlloc)/uint64(finishedCounter)/1024, (memEnd.Mallocs-memStart.Mallocs)/uint64(finishedCounter))
+		}
+		allocated, reused := canvases.Stats()
+		fmt.Printf("Canvases: %d allocated, %d reused\n", allocated, reused)
+		allocated, reused = encodeBuffers.Stats()
+		fmt.Printf("Encode buffers: %d allocated, %d reused\n", allocated, reused)
+	}
+}
+
+// writePlan prints the plan of a dry run to stdout and its summary to the log.
+// If only is set, the plan is restricted to these tiles.
+func writePlan(ctx context.Context, format string, indexer *Indexer, only map[string]bool, quiet bool) {
+	plan := newPlan()
+	err := indexer.Run(ctx, func(indexed IndexedTile) bool {
+		if only == nil || only[indexed.Tile.String()] {
+			plan.Add(indexed.Tile, indexed.Sources, indexed.Exists)
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatalf("could not index tilesets: %v", err)
+	}
+	if format == "csv" {
+		err = plan.WriteCSV(os.Stdout)
+	} else {
+		err = plan.WriteJSON(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !quiet {
+		for _, line := range plan.SummaryLines() {
+			log.Println(line)
+		}
+	}
+}
+
+func tilesetPointers(tilesets []TilesetDescriptor) []*TilesetDescriptor {
+	result := make([]*TilesetDescriptor, len(tilesets))
+	for i := range tilesets {
+		result[i] = &tilesets[i]
 	}
+	return result
+}
+
+// localBackend returns the filesystem backend behind backend, if any.
+func localBackend(backend StorageBackend) (*FsBackend.FsBackend, bool) {
+	fs, ok := baseBackend(backend).(*FsBackend.FsBackend)
+	return fs, ok
 }
 
-func stringToBackend(pathSpec string, failNonexistent bool, timeout int) (StorageBackend, error) {
+func stringToBackend(pathSpec string, failNonexistent bool, timeout int, retry *RetryPolicy) (StorageBackend, error) {
 	if strings.HasPrefix(pathSpec, "http") {
 		backend, err := S3Backend.NewS3Backend(pathSpec, timeout)
 		if err != nil {
 			return nil, err
 		}
-		return backend, nil
+		return withRetry(backend, retry), nil
+	}
+
+	if strings.HasPrefix(pathSpec, "mbtiles://") || strings.HasSuffix(pathSpec, ".mbtiles") {
+		backend, err := MBTilesBackend.NewMBTilesBackend(pathSpec, !failNonexistent)
+		if err != nil {
+			return nil, err
+		}
+		return withRetry(backend, retry), nil
+	}
+
+	if strings.HasPrefix(pathSpec, "pmtiles://") || strings.HasSuffix(pathSpec, ".pmtiles") {
+		backend, err := PMTilesBackend.NewPMTilesBackend(pathSpec, !failNonexistent)
+		if err != nil {
+			return nil, err
+		}
+		return withRetry(backend, retry), nil
 	}
 
 	// Default: local filesystem.
@@ -329,5 +928,5 @@ func stringToBackend(pathSpec string, failNonexistent bool, timeout int) (Storag
 			}
 		}
 	}
-	return &FsBackend.FsBackend{BasePath: pathSpec}, nil
+	return withRetry(&FsBackend.FsBackend{BasePath: pathSpec}, retry), nil
 }
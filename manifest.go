@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/v4lli/prioritile/FsBackend"
+	"github.com/v4lli/prioritile/MBTilesBackend"
+	"github.com/v4lli/prioritile/PMTilesBackend"
+)
+
+// VersionedBackend is implemented by backends which can cheaply report a token
+// (e.g. an ETag or mtime) that changes whenever the content of a file changes.
+type VersionedBackend interface {
+	GetFileVersion(ctx context.Context, filename string) (string, error)
+}
+
+const manifestName = ".prioritile-manifest.json"
+
+// ManifestEntry records what a target tile was built from.
+type ManifestEntry struct {
+	// Names of all candidate sources, in z-order
+	Sources []string `json:"sources"`
+	// Versions of the sources which actually contributed to the tile (the
+	// ones below a fully opaque tile are never looked at)
+	Inputs map[string]string `json:"inputs"`
+	// Hash of the tile that was written and its version in the target
+	Output        string `json:"output"`
+	OutputVersion string `json:"output_version,omitempty"`
+}
+
+// Manifest allows skipping target tiles whose inputs haven't changed since
+// the last run.
+type Manifest struct {
+	Tiles map[string]ManifestEntry `json:"tiles"`
+	// Force rebuilds all tiles, Unchanged never holds. New entries are still
+	// recorded.
+	Force bool `json:"-"`
+
+	mu       sync.Mutex
+	backend  StorageBackend
+	filename string
+}
+
+// manifestLocation returns where the manifest for a target is stored: in the
+// root of directory-like targets, next to archive files otherwise.
+func manifestLocation(target StorageBackend, path string) (StorageBackend, string) {
+	if len(path) == 0 {
+		switch b := baseBackend(target).(type) {
+		case *MBTilesBackend.MBTilesBackend:
+			path = b.Path + manifestName
+		case *PMTilesBackend.PMTilesBackend:
+			path = b.Path + manifestName
+		default:
+			return target, manifestName
+		}
+	}
+	return &FsBackend.FsBackend{BasePath: filepath.Dir(path)}, filepath.Base(path)
+}
+
+func LoadManifest(ctx context.Context, backend StorageBackend, filename string) (*Manifest, error) {
+	m := &Manifest{
+		Tiles:    map[string]ManifestEntry{},
+		backend:  backend,
+		filename: filename,
+	}
+	if !backend.FileExists(ctx, filename) {
+		return m, nil
+	}
+	f, err := backend.GetFile(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(f, m); err != nil {
+		return nil, err
+	}
+	if m.Tiles == nil {
+		m.Tiles = map[string]ManifestEntry{}
+	}
+	return m, nil
+}
+
+func (m *Manifest) Save(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(m); err != nil {
+		return err
+	}
+	return m.backend.PutFile(ctx, m.filename, buf)
+}
+
+func contentHash(content []byte) string {
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileVersion returns a token identifying the current content of filename.
+// If the backend can't provide one, the content hash is used (content is
+// fetched if nil).
+func fileVersion(ctx context.Context, backend StorageBackend, filename string, content []byte) (string, error) {
+	if versioned, ok := backend.(VersionedBackend); ok {
+		return versioned.GetFileVersion(ctx, filename)
+	}
+	if content == nil {
+		var err error
+		content, err = backend.GetFile(ctx, filename)
+		if err != nil {
+			return "", err
+		}
+	}
+	return contentHash(content), nil
+}
+
+func sourceNames(sources []*TilesetDescriptor) []string {
+	names := make([]string, len(sources))
+	for i, s := range sources {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Unchanged reports whether the target tile is still what the last run wrote
+// and none of the sources which contributed to it have changed.
+func (m *Manifest) Unchanged(ctx context.Context, tile TileDescriptor, sources []*TilesetDescriptor, target StorageBackend) bool {
+	if m.Force {
+		return false
+	}
+	m.mu.Lock()
+	entry, ok := m.Tiles[tile.String()]
+	m.mu.Unlock()
+	if !ok || strings.Join(entry.Sources, "\n") != strings.Join(sourceNames(sources), "\n") {
+		return false
+	}
+
+	if len(entry.OutputVersion) > 0 {
+		version, err := fileVersion(ctx, target, tile.String(), nil)
+		if err != nil || version != entry.OutputVersion {
+			return false
+		}
+	} else {
+		f, err := target.GetFile(ctx, tile.String())
+		if err != nil || contentHash(f) != entry.Output {
+			return false
+		}
+	}
+
+	for _, source := range sources {
+		recorded, ok := entry.Inputs[source.Name]
+		if !ok {
+			continue
+		}
+		sourceTile, ok := source.Resolve(tile)
+		if !ok {
+			return false
+		}
+		version, err := fileVersion(ctx, source.Backend, sourceTile.String(), nil)
+		if err != nil || version != recorded {
+			return false
+		}
+	}
+	return true
+}
+
+// Record remembers the inputs of a tile which has just been written to the
+// target.
+func (m *Manifest) Record(ctx context.Context, tile string, sources []*TilesetDescriptor, inputs map[string]string, target StorageBackend, content []byte) error {
+	entry := ManifestEntry{
+		Sources: sourceNames(sources),
+		Inputs:  inputs,
+		Output:  contentHash(content),
+	}
+	if versioned, ok := target.(VersionedBackend); ok {
+		version, err := versioned.GetFileVersion(ctx, tile)
+		if err != nil {
+			return err
+		}
+		entry.OutputVersion = version
+	}
+	m.mu.Lock()
+	m.Tiles[tile] = entry
+	m.mu.Unlock()
+	return nil
+}
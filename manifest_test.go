@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+// writeTile writes content to a tile of backend.
+func writeTile(t *testing.T, backend StorageBackend, tile string, content string) {
+	ctx := context.Background()
+	require.NoError(t, backend.MkdirAll(ctx, filepath.Dir(tile)+"/"))
+	require.NoError(t, backend.PutFile(ctx, tile, bytes.NewBufferString(content)))
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	target := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	base := &TilesetDescriptor{Name: "base", Backend: &FsBackend.FsBackend{BasePath: t.TempDir()}}
+	overlay := &TilesetDescriptor{Name: "overlay", Backend: &FsBackend.FsBackend{BasePath: t.TempDir()}}
+	sources := []*TilesetDescriptor{base, overlay}
+	tile := TileDescriptor{Z: 1, X: 0, Y: 1, Format: "png"}
+	writeTile(t, base.Backend, tile.String(), "base")
+	writeTile(t, overlay.Backend, tile.String(), "overlay")
+
+	// merge writes the tile and records its inputs like a run would
+	merge := func(m *Manifest, sources []*TilesetDescriptor) {
+		inputs := map[string]string{}
+		for _, source := range sources {
+			version, err := fileVersion(ctx, source.Backend, tile.String(), nil)
+			require.NoError(t, err)
+			inputs[source.Name] = version
+		}
+		writeTile(t, target, tile.String(), "merged")
+		require.NoError(t, m.Record(ctx, tile.String(), sources, inputs, target, []byte("merged")))
+		require.NoError(t, m.Save(ctx))
+	}
+
+	m, err := LoadManifest(ctx, target, manifestName)
+	require.NoError(t, err)
+	assert.Empty(t, m.Tiles)
+	assert.False(t, m.Unchanged(ctx, tile, sources, target))
+	merge(m, sources)
+
+	// Nothing changed since the last run
+	m, err = LoadManifest(ctx, target, manifestName)
+	require.NoError(t, err)
+	require.Contains(t, m.Tiles, tile.String())
+	assert.Equal(t, []string{"base", "overlay"}, m.Tiles[tile.String()].Sources)
+	assert.True(t, m.Unchanged(ctx, tile, sources, target))
+
+	// unless the tile is forced to be rebuilt
+	m.Force = true
+	assert.False(t, m.Unchanged(ctx, tile, sources, target))
+	m.Force = false
+
+	// or the stack of sources is a different one
+	assert.False(t, m.Unchanged(ctx, tile, []*TilesetDescriptor{overlay, base}, target))
+	assert.False(t, m.Unchanged(ctx, tile, []*TilesetDescriptor{base}, target))
+
+	// or a source tile has changed
+	later := time.Now().Add(time.Minute)
+	path := filepath.Join(overlay.Backend.(*FsBackend.FsBackend).BasePath, tile.String())
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.False(t, m.Unchanged(ctx, tile, sources, target))
+	merge(m, sources)
+	assert.True(t, m.Unchanged(ctx, tile, sources, target))
+
+	// or the target tile was modified by someone else
+	writeTile(t, target, tile.String(), "modified")
+	assert.False(t, m.Unchanged(ctx, tile, sources, target))
+}
+
+func TestManifestContentHash(t *testing.T) {
+	ctx := context.Background()
+	// A target without versions is compared by the hash of its tiles
+	fs := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	target := struct{ StorageBackend }{fs}
+	source := &TilesetDescriptor{Name: "source", Backend: struct{ StorageBackend }{&FsBackend.FsBackend{BasePath: t.TempDir()}}}
+	sources := []*TilesetDescriptor{source}
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	writeTile(t, source.Backend, tile.String(), "source")
+	writeTile(t, target, tile.String(), "merged")
+
+	m, err := LoadManifest(ctx, target, manifestName)
+	require.NoError(t, err)
+	version, err := fileVersion(ctx, source.Backend, tile.String(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, contentHash([]byte("source")), version)
+	require.NoError(t, m.Record(ctx, tile.String(), sources, map[string]string{source.Name: version}, target, []byte("merged")))
+	assert.Empty(t, m.Tiles[tile.String()].OutputVersion)
+	assert.True(t, m.Unchanged(ctx, tile, sources, target))
+
+	writeTile(t, source.Backend, tile.String(), "changed")
+	assert.False(t, m.Unchanged(ctx, tile, sources, target))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// perfCounters collects the durations of the single merge steps for -debug.
+// The zero value discards all measurements.
+type perfCounters struct {
+	fetch              chan time.Duration
+	backwardsIteration chan time.Duration
+	opaquenessCheck    chan time.Duration
+	alphaCheck         chan time.Duration
+	draw               chan time.Duration
+	encode             chan time.Duration
+}
+
+func observe(counter chan time.Duration, start time.Time) {
+	if counter != nil {
+		counter <- time.Since(start)
+	}
+}
+
+// Merger applies the painter's algorithm to a single tile.
+type Merger struct {
+	// Target is used as the bottom-most layer unless a fully opaque source
+	// tile covers it. nil if the target must not be read.
+	Target StorageBackend
+	// BestEffort skips sources which can't be fetched or decoded instead of
+	// failing the whole tile.
+	BestEffort bool
+	// OverzoomFilter is used to upsample ancestor tiles of overzoomed
+	// sources (bilinear if nil).
+	OverzoomFilter draw.Interpolator
+	// Format the result is encoded in (PNG if nil)
+	Format *OutputFormat
+	// TileSize is the width and height of the result in pixels, layers of
+	// other sizes are resampled with ResampleFilter (bilinear if nil). If 0,
+	// the size of the largest layer is used.
+	TileSize       int
+	ResampleFilter draw.Interpolator
+	// StrictSize rejects tiles whose layers don't match the tile size
+	// instead of resampling them.
+	StrictSize bool
+	// Failures collects the sources skipped in best-effort mode, if set.
+	Failures *FailureReport
+	Counters perfCounters
+}
+
+// skip returns whether a failed source can be skipped. If so, the failure is
+// logged and recorded.
+func (m *Merger) skip(err *TileError) bool {
+	if !m.BestEffort {
+		return false
+	}
+	log.Println(err)
+	if m.Failures != nil {
+		m.Failures.Add(err.Tile, err.Stage, err)
+	}
+	return true
+}
+
+// overzoom crops the quadrant covering tile out of its ancestor's image and
+// scales it up to the full tile size.
+func (m *Merger) overzoom(img image.Image, tile TileDescriptor, ancestor TileDescriptor) image.Image {
+	filter := m.OverzoomFilter
+	if filter == nil {
+		filter = draw.BiLinear
+	}
+	level := uint(tile.Z - ancestor.Z)
+	b := img.Bounds()
+	w, h := b.Dx()>>level, b.Dy()>>level
+	x := b.Min.X + (tile.X-ancestor.X<<level)*w
+	y := b.Min.Y + (tile.Y-ancestor.Y<<level)*h
+	result := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	filter.Scale(result, result.Bounds(), img, image.Rect(x, y, x+w, y+h), draw.Src, nil)
+	return result
+}
+
+// layer is a decoded tile and how it is painted.
+type layer struct {
+	name    string
+	img     image.Image
+	options SourceOptions
+	// The encoded tile, if it may be used as the result as-is
+	raw    []byte
+	format string
+}
+
+// FitsTileSize reports whether an encoded tile can be used as the result
+// without resampling it.
+func (m *Merger) FitsTileSize(content []byte) bool {
+	if m.TileSize == 0 {
+		return true
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	return err == nil && config.Width == m.TileSize && config.Height == m.TileSize
+}
+
+// resize brings all layers to the same size, see TileSize.
+func (m *Merger) resize(layers []layer) (image.Point, error) {
+	size := image.Pt(m.TileSize, m.TileSize)
+	if m.TileSize == 0 {
+		for _, l := range layers {
+			if b := l.img.Bounds(); b.Dx()*b.Dy() > size.X*size.Y {
+				size = b.Size()
+			}
+		}
+	}
+	filter := m.ResampleFilter
+	if filter == nil {
+		filter = draw.BiLinear
+	}
+	for i, l := range layers {
+		b := l.img.Bounds()
+		if b.Size() == size {
+			continue
+		}
+		if m.StrictSize {
+			return size, fmt.Errorf("size mismatch: %s is %dx%d, expected %dx%d", l.name, b.Dx(), b.Dy(), size.X, size.Y)
+		}
+		resized := image.NewRGBA(image.Rectangle{Max: size})
+		filter.Scale(resized, resized.Bounds(), l.img, b, draw.Src, nil)
+		layers[i].img = resized
+	}
+	return size, nil
+}
+
+// Merge fetches and composes a tile, see Fetch and Compose. It returns nil if
+// there is nothing to write. If inputs is not nil, the versions of all source
+// tiles which were looked at are stored in it.
+func (m *Merger) Merge(ctx context.Context, tile TileDescriptor, sources []*TilesetDescriptor, inputs map[string]string) ([]byte, error) {
+	fetched, err := m.Fetch(ctx, tile, sources, inputs != nil)
+	if err != nil {
+		return nil, err
+	}
+	return m.Compose(ctx, fetched, inputs)
+}
+
+// Compose iterates the fetched source tiles backwards until a fully opaque tile
+// has been found, then merges all tiles up to that one and returns the encoded
+// result. If a tile which made Fetch stop turns out to be unusable, the
+// sources below it are fetched here. It returns nil if there is nothing to write. If inputs is not nil,
+// the versions of all source tiles which were looked at are stored in it.
+func (m *Merger) Compose(ctx context.Context, fetched *FetchedTile, inputs map[string]string) ([]byte, error) {
+	tile := fetched.Tile
+	var toMerge []layer
+	opaque := false
+	startBackwardsIteration := time.Now()
+	for i := 0; !opaque; i++ {
+		if i == len(fetched.sources) {
+			if len(fetched.rest) == 0 {
+				break
+			}
+			// A tile Fetch took for opaque couldn't be used, so the sources
+			// below are needed after all
+			if err := m.fetchMore(ctx, fetched); err != nil {
+				return nil, err
+			}
+		}
+		s := fetched.sources[i]
+		if s.err != nil {
+			if ctx.Err() != nil || !m.skip(s.err) {
+				return nil, s.err
+			}
+			continue
+		}
+		if inputs != nil {
+			inputs[s.source.Name] = s.version
+		}
+		img, _, err := image.Decode(bytes.NewBuffer(s.content))
+		if err != nil {
+			if err := (&TileError{tile, s.source.Name, stageDecode, err}); !m.skip(err) {
+				return nil, err
+			}
+			continue
+		}
+		img, err = applyNoData(img, s.source.Options)
+		if err != nil {
+			return nil, &TileError{tile, s.source.Name, stageCompose, fmt.Errorf("nodata rules: %w", err)}
+		}
+		if s.tile.Z < tile.Z {
+			img = m.overzoom(img, tile, s.tile)
+		}
+		if s.source.cutline != nil {
+			img = applyCutline(img, s.source.cutline, tile)
+		}
+
+		counterAlphaCheckStart := time.Now()
+		skip, hasAlphaPixel := analyzeAlpha(img)
+		observe(m.Counters.alphaCheck, counterAlphaCheckStart)
+		if skip {
+			continue
+		}
+		options := s.source.Options
+		l := layer{name: s.source.Name, img: img, options: options}
+		if s.tile.Z == tile.Z && options.Unmodified() && (options.Blend == "over" || options.Blend == "replace") {
+			l.raw, l.format = s.content, s.tile.Format
+		}
+		toMerge = append([]layer{l}, toMerge...)
+		// Only a layer painted fully opaque over everything hides what's below
+		if !hasAlphaPixel && options.Opacity >= 1 && (options.Blend == "over" || options.Blend == "replace") {
+			opaque = true
+		}
+	}
+	observe(m.Counters.backwardsIteration, startBackwardsIteration)
+	// Sources skipped because of an abort would leave a wrong result
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	counterOpaquenessCheckStart := time.Now()
+	if !opaque && m.Target != nil {
+		targetF := fetched.target
+		if !fetched.targetFetch {
+			// The last source tile Fetch relied on to cover the target
+			// couldn't be used
+			targetF, _ = m.Target.GetFile(ctx, tile.String())
+		}
+		if targetF != nil {
+			img, _, err := image.Decode(bytes.NewBuffer(targetF))
+			if err != nil {
+				return nil, &TileError{tile, "target", stageDecode, err}
+			}
+			toMerge = append([]layer{{name: "target", img: img, options: defaultSourceOptions()}}, toMerge...)
+		}
+	}
+	observe(m.Counters.opaquenessCheck, counterOpaquenessCheckStart)
+	if len(toMerge) < 1 {
+		return nil, nil
+	}
+
+	format := m.Format
+	if format == nil {
+		format = DefaultOutputFormat
+	}
+	// A single layer painted onto nothing is the result as it is
+	if only := toMerge[0]; len(toMerge) == 1 && only.raw != nil && format.sameFormat(only.format) && format.keepsEncoding(only.raw) &&
+		(m.TileSize == 0 || only.img.Bounds().Size() == image.Pt(m.TileSize, m.TileSize)) {
+		return only.raw, nil
+	}
+
+	counterDrawStart := time.Now()
+	size, err := m.resize(toMerge)
+	if err != nil {
+		return nil, &TileError{tile, "", stageCompose, err}
+	}
+	// All layers are painted bottom-up into the same canvas
+	merged := canvases.Get(size)
+	defer canvases.Put(merged)
+	for _, l := range toMerge {
+		blendLayer(merged, l.img, l.options.Blend, l.options.Opacity)
+	}
+	observe(m.Counters.draw, counterDrawStart)
+
+	counterEncodeStart := time.Now()
+	buf := encodeBuffers.Get()
+	defer encodeBuffers.Put(buf)
+	if err := format.Encode(buf, merged); err != nil {
+		return nil, &TileError{tile, "", stageEncode, err}
+	}
+	observe(m.Counters.encode, counterEncodeStart)
+	// The buffer is reused, so the result needs its own copy
+	return append([]byte(nil), buf.Bytes()...), nil
+}
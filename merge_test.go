@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+// testTileset returns a tileset with a single tile 0/0/0.png of the given
+// size, filled with c up to column fillX.
+func testTileset(t *testing.T, name string, size int, fillX int, c color.NRGBA) *TilesetDescriptor {
+	ctx := context.Background()
+	backend := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < fillX; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, img))
+	require.NoError(t, backend.MkdirAll(ctx, "0/0/"))
+	require.NoError(t, backend.PutFile(ctx, "0/0/0.png", buf))
+	return &TilesetDescriptor{Name: name, Backend: backend, Options: defaultSourceOptions()}
+}
+
+func TestMergeTileSize(t *testing.T) {
+	ctx := context.Background()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	legacy := testTileset(t, "legacy", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	// Left half only, so the legacy layer shows through on the right
+	retina := testTileset(t, "retina", 512, 256, color.NRGBA{G: 0xff, A: 0xff})
+	sources := []*TilesetDescriptor{legacy, retina}
+
+	for tileSize, expected := range map[int]int{0: 512, 512: 512, 256: 256} {
+		merger := &Merger{TileSize: tileSize}
+		content, err := merger.Merge(ctx, tile, sources, nil)
+		require.NoError(t, err)
+		assert.True(t, merger.FitsTileSize(content))
+		img, _, err := image.Decode(bytes.NewReader(content))
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, expected, expected), img.Bounds())
+		assert.Equal(t, color.RGBA{G: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(0, expected-1)))
+		assert.Equal(t, color.RGBA{R: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(expected-1, expected-1)))
+	}
+
+	merger := &Merger{TileSize: 256}
+	legacyContent, err := legacy.Backend.GetFile(ctx, "0/0/0.png")
+	require.NoError(t, err)
+	assert.True(t, merger.FitsTileSize(legacyContent))
+	merger.TileSize = 512
+	assert.False(t, merger.FitsTileSize(legacyContent))
+
+	merger = &Merger{TileSize: 512, StrictSize: true}
+	_, err = merger.Merge(ctx, tile, sources, nil)
+	assert.EqualError(t, err, "failed to compose 0/0/0.png: size mismatch: legacy is 256x256, expected 512x512")
+	merger = &Merger{StrictSize: true}
+	_, err = merger.Merge(ctx, tile, sources, nil)
+	assert.Error(t, err)
+}
+
+func TestMergeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	sources := []*TilesetDescriptor{testTileset(t, "half", 256, 128, color.NRGBA{B: 0xff, A: 0xff})}
+
+	// Even in best-effort mode, an aborted merge must not yield a result
+	content, err := (&Merger{BestEffort: true}).Merge(ctx, tile, sources, nil)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Nil(t, content)
+}
+
+func TestMergePassthrough(t *testing.T) {
+	ctx := context.Background()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	below := testTileset(t, "below", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	scene := testTileset(t, "scene", 256, 256, color.NRGBA{G: 0xff, A: 0xff})
+	raw, err := scene.Backend.GetFile(ctx, "0/0/0.png")
+	require.NoError(t, err)
+
+	content, err := (&Merger{}).Merge(ctx, tile, []*TilesetDescriptor{below, scene}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, raw, content)
+
+	// Layers which have to be changed are merged
+	scene.Options.Opacity = 0.5
+	content, err = (&Merger{}).Merge(ctx, tile, []*TilesetDescriptor{below, scene}, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, raw, content)
+	scene.Options.Opacity = 1
+	for _, merger := range []*Merger{{TileSize: 512}, {Format: &OutputFormat{Name: "webp-lossless"}}} {
+		content, err = merger.Merge(ctx, tile, []*TilesetDescriptor{scene}, nil)
+		require.NoError(t, err)
+		assert.NotEqual(t, raw, content)
+	}
+}
+
+func TestMergeFailures(t *testing.T) {
+	ctx := context.Background()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	broken := testTileset(t, "broken", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	require.NoError(t, broken.Backend.PutFile(ctx, "0/0/0.png", bytes.NewBufferString("garbage")))
+	sources := []*TilesetDescriptor{testTileset(t, "base", 256, 256, color.NRGBA{G: 0xff, A: 0xff}), broken}
+
+	_, err := (&Merger{}).Merge(ctx, tile, sources, nil)
+	var tileErr *TileError
+	require.True(t, errors.As(err, &tileErr))
+	assert.Equal(t, "broken", tileErr.Source)
+	assert.Equal(t, stageDecode, tileErr.Stage)
+
+	failures := &FailureReport{}
+	content, err := (&Merger{BestEffort: true, Failures: failures}).Merge(ctx, tile, sources, nil)
+	require.NoError(t, err)
+	assert.NotNil(t, content)
+	require.Len(t, failures.Failures, 1)
+	assert.Equal(t, Failure{Tile: "0/0/0.png", Source: "broken", Stage: stageDecode, Error: tileErr.Error()}, failures.Failures[0])
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// maxOverzoom caps the overzoom option, every level quadruples the number of
+// tiles a source tile is spread over.
+const maxOverzoom = 8
+
+// blendModes are the supported values of the blend option. "over" paints the
+// source on top (the default), "replace" swaps out everything below wherever
+// the source has data.
+var blendModes = []string{"over", "multiply", "screen", "darken", "lighten", "replace"}
+
+// SourceOptions are per-source settings. On the command line, they are
+// appended to the location of a source, e.g. 'tiles/source1/#overzoom=2'.
+type SourceOptions struct {
+	// Number of zoom levels missing tiles are upsampled from ancestor tiles
+	Overzoom int `json:"overzoom,omitempty"`
+	// Opacity (0-1) the source is painted with
+	Opacity float64 `json:"opacity"`
+	// How the source is combined with the layers below, see blendModes
+	Blend string `json:"blend,omitempty"`
+	// Color treated as NODATA, as RRGGBB hex with an optional per-channel
+	// tolerance, e.g. "000000" or "ffffff~10"
+	NoData string `json:"nodata,omitempty"`
+	// Pixels with an alpha value below this (0-255) are treated as NODATA
+	AlphaThreshold int `json:"alpha-threshold,omitempty"`
+	// GeoJSON file (EPSG:4326) with the polygons the source is limited to
+	Cutline string `json:"cutline,omitempty"`
+	// Tile layout of the source: xyz, tms, quadkey or a path template
+	Scheme string `json:"scheme,omitempty"`
+}
+
+func defaultSourceOptions() SourceOptions {
+	return SourceOptions{Opacity: 1, Blend: "over", Scheme: "xyz"}
+}
+
+// Unmodified reports whether tiles of a source are painted as they are, i.e.
+// a tile without anything below is the same as the merge result.
+func (o SourceOptions) Unmodified() bool {
+	return o.Opacity >= 1 && len(o.NoData) == 0 && o.AlphaThreshold == 0 && len(o.Cutline) == 0
+}
+
+// SourceSpec is a source directive: the location of a tileset and its options.
+type SourceSpec struct {
+	Path string `json:"path"`
+	SourceOptions
+}
+
+// String renders the directive in the command line format, with the options
+// in a canonical order.
+func (s SourceSpec) String() string {
+	var opts []string
+	defaults := defaultSourceOptions()
+	if s.Overzoom != defaults.Overzoom {
+		opts = append(opts, fmt.Sprintf("overzoom=%d", s.Overzoom))
+	}
+	if s.Opacity != defaults.Opacity {
+		opts = append(opts, "opacity="+strconv.FormatFloat(s.Opacity, 'g', -1, 64))
+	}
+	if s.Blend != defaults.Blend {
+		opts = append(opts, "blend="+s.Blend)
+	}
+	if s.NoData != defaults.NoData {
+		opts = append(opts, "nodata="+s.NoData)
+	}
+	if s.AlphaThreshold != defaults.AlphaThreshold {
+		opts = append(opts, fmt.Sprintf("alpha-threshold=%d", s.AlphaThreshold))
+	}
+	if s.Cutline != defaults.Cutline {
+		opts = append(opts, "cutline="+s.Cutline)
+	}
+	if s.Scheme != defaults.Scheme {
+		opts = append(opts, "scheme="+s.Scheme)
+	}
+	if len(opts) == 0 {
+		return s.Path
+	}
+	return s.Path + "#" + strings.Join(opts, ",")
+}
+
+// parseSourceSpec splits a source directive into the location and its options.
+func parseSourceSpec(spec string) (SourceSpec, error) {
+	result := SourceSpec{Path: spec, SourceOptions: defaultSourceOptions()}
+	idx := strings.LastIndex(spec, "#")
+	if idx < 0 {
+		return result, nil
+	}
+	result.Path = spec[:idx]
+	for _, option := range strings.Split(spec[idx+1:], ",") {
+		if len(option) == 0 {
+			continue
+		}
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return SourceSpec{}, fmt.Errorf("invalid option %s for %s, expected key=value", option, spec)
+		}
+		if err := result.Set(parts[0], parts[1]); err != nil {
+			return SourceSpec{}, fmt.Errorf("invalid option %s for %s: %w", option, spec, err)
+		}
+	}
+	return result, nil
+}
+
+func (o *SourceOptions) Set(key string, value string) error {
+	switch key {
+	case "overzoom":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		o.Overzoom = n
+	case "opacity":
+		opacity, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		o.Opacity = opacity
+	case "blend":
+		o.Blend = value
+	case "nodata":
+		o.NoData = value
+	case "alpha-threshold":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		o.AlphaThreshold = n
+	case "cutline":
+		o.Cutline = value
+	case "scheme":
+		o.Scheme = value
+	default:
+		return fmt.Errorf("unknown option %s", key)
+	}
+	return o.Validate()
+}
+
+func (o *SourceOptions) Validate() error {
+	if o.Overzoom < 0 || o.Overzoom > maxOverzoom {
+		return fmt.Errorf("overzoom must be between 0 and %d", maxOverzoom)
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return fmt.Errorf("opacity must be between 0 and 1")
+	}
+	if o.AlphaThreshold < 0 || o.AlphaThreshold > 255 {
+		return fmt.Errorf("alpha-threshold must be between 0 and 255")
+	}
+	if len(o.NoData) > 0 {
+		if _, err := parseNoData(o.NoData); err != nil {
+			return err
+		}
+	}
+	if _, err := parseScheme(o.Scheme); err != nil {
+		return err
+	}
+	for _, mode := range blendModes {
+		if mode == o.Blend {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown blend mode %s, valid modes are: %s", o.Blend, strings.Join(blendModes, ", "))
+}
+
+func parseSourceSpecs(specs []string) ([]SourceSpec, error) {
+	result := make([]SourceSpec, len(specs))
+	for i, spec := range specs {
+		var err error
+		if result[i], err = parseSourceSpec(spec); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// loadConfig reads the source directives from a JSON config file, e.g.
+// {"sources": [{"path": "tiles/base/"}, {"path": "tiles/hillshade/", "opacity": 0.5, "blend": "multiply"}]}
+func loadConfig(path string) ([]SourceSpec, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Sources []json.RawMessage `json:"sources"`
+	}
+	if err := json.Unmarshal(f, &raw); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	specs := make([]SourceSpec, len(raw.Sources))
+	for i, source := range raw.Sources {
+		specs[i].SourceOptions = defaultSourceOptions()
+		if err := json.Unmarshal(source, &specs[i]); err != nil {
+			return nil, fmt.Errorf("invalid source in config %s: %w", path, err)
+		}
+		if len(specs[i].Path) == 0 {
+			return nil, fmt.Errorf("source without path in config %s", path)
+		}
+		if err := specs[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid source %s in config %s: %w", specs[i].Path, path, err)
+		}
+	}
+	return specs, nil
+}
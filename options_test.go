@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSourceSpec(t *testing.T) {
+	spec, err := parseSourceSpec("https://example.com/bucket/tiles/#overzoom=3")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/bucket/tiles/", spec.Path)
+	assert.Equal(t, 3, spec.Overzoom)
+
+	spec, err = parseSourceSpec("tiles/")
+	require.NoError(t, err)
+	assert.Equal(t, "tiles/", spec.Path)
+	assert.Equal(t, defaultSourceOptions(), spec.SourceOptions)
+	assert.Equal(t, "tiles/", spec.String())
+
+	spec, err = parseSourceSpec("tiles/#blend=multiply,opacity=0.5")
+	require.NoError(t, err)
+	assert.Equal(t, "multiply", spec.Blend)
+	assert.Equal(t, 0.5, spec.Opacity)
+	assert.Equal(t, "tiles/#opacity=0.5,blend=multiply", spec.String())
+
+	spec, err = parseSourceSpec("tiles/#nodata=ffffff~10,alpha-threshold=32")
+	require.NoError(t, err)
+	assert.Equal(t, "ffffff~10", spec.NoData)
+	assert.Equal(t, 32, spec.AlphaThreshold)
+	assert.Equal(t, "tiles/#nodata=ffffff~10,alpha-threshold=32", spec.String())
+
+	spec, err = parseSourceSpec("tiles/#cutline=footprint.geojson")
+	require.NoError(t, err)
+	assert.Equal(t, "footprint.geojson", spec.Cutline)
+
+	_, err = parseSourceSpec("tiles/#overzoom=99")
+	assert.Error(t, err)
+	_, err = parseSourceSpec("tiles/#foo=bar")
+	assert.Error(t, err)
+	_, err = parseSourceSpec("tiles/#overzoom")
+	assert.Error(t, err)
+	_, err = parseSourceSpec("tiles/#opacity=2")
+	assert.Error(t, err)
+	_, err = parseSourceSpec("tiles/#blend=overlay")
+	assert.Error(t, err)
+	_, err = parseSourceSpec("tiles/#nodata=black")
+	assert.Error(t, err)
+	_, err = parseSourceSpec("tiles/#alpha-threshold=256")
+	assert.Error(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"sources": [
+		{"path": "tiles/base/"},
+		{"path": "tiles/hillshade/", "opacity": 0.5, "blend": "multiply", "overzoom": 1}
+	]}`), 0644))
+	specs, err := loadConfig(path)
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, SourceSpec{Path: "tiles/base/", SourceOptions: defaultSourceOptions()}, specs[0])
+	assert.Equal(t, SourceSpec{Path: "tiles/hillshade/", SourceOptions: SourceOptions{Overzoom: 1, Opacity: 0.5, Blend: "multiply", Scheme: "xyz"}}, specs[1])
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"sources": [{"path": "tiles/", "blend": "overlay"}]}`), 0644))
+	_, err = loadConfig(path)
+	assert.Error(t, err)
+}
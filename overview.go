@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"sort"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// buildOverviews rebuilds the parents of all changed tiles by downsampling
+// their four children, level by level down to minZ. Only parents with at least
+// one changed child are touched.
+func buildOverviews(ctx context.Context, target StorageBackend, changed []TileDescriptor, minZ int, filter draw.Interpolator, format *OutputFormat, workers int, bestEffort bool) (int, error) {
+	byZoom := map[int]map[string]TileDescriptor{}
+	maxZ := -1
+	for _, tile := range changed {
+		if byZoom[tile.Z] == nil {
+			byZoom[tile.Z] = map[string]TileDescriptor{}
+		}
+		byZoom[tile.Z][tile.String()] = tile
+		if tile.Z > maxZ {
+			maxZ = tile.Z
+		}
+	}
+
+	built := 0
+	for z := maxZ; z > minZ; z-- {
+		parents := map[string]TileDescriptor{}
+		for _, tile := range byZoom[z] {
+			parent := TileDescriptor{Z: z - 1, X: tile.X / 2, Y: tile.Y / 2, Format: tile.Format}
+			parents[parent.String()] = parent
+		}
+		if len(parents) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(parents))
+		for key := range parents {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var mu sync.Mutex
+		var firstErr error
+		var wg sync.WaitGroup
+		jobs := make(chan TileDescriptor)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for parent := range jobs {
+					ok, err := buildOverviewTile(ctx, target, parent, filter, format)
+					mu.Lock()
+					if err != nil {
+						if bestEffort {
+							log.Println(err)
+						} else if firstErr == nil {
+							firstErr = err
+						}
+					} else if ok {
+						if byZoom[parent.Z] == nil {
+							byZoom[parent.Z] = map[string]TileDescriptor{}
+						}
+						byZoom[parent.Z][parent.String()] = parent
+						built++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, key := range keys {
+			jobs <- parents[key]
+		}
+		close(jobs)
+		wg.Wait()
+		if firstErr != nil {
+			return built, firstErr
+		}
+	}
+	return built, nil
+}
+
+// buildOverviewTile downsamples the (up to) four children of parent into it.
+// It returns false if none of the children exist.
+func buildOverviewTile(ctx context.Context, target StorageBackend, parent TileDescriptor, filter draw.Interpolator, format *OutputFormat) (bool, error) {
+	var children [4]image.Image
+	size := 0
+	for i := range children {
+		child := TileDescriptor{Z: parent.Z + 1, X: parent.X*2 + i%2, Y: parent.Y*2 + i/2, Format: parent.Format}
+		if !target.FileExists(ctx, child.String()) {
+			continue
+		}
+		f, err := target.GetFile(ctx, child.String())
+		if err != nil {
+			return false, fmt.Errorf("failed to get %s for overview: %w", child, err)
+		}
+		img, _, err := image.Decode(bytes.NewBuffer(f))
+		if err != nil {
+			return false, fmt.Errorf("failed to decode %s for overview: %w", child, err)
+		}
+		children[i] = img
+		if img.Bounds().Dx() > size {
+			size = img.Bounds().Dx()
+		}
+	}
+	if size == 0 {
+		return false, nil
+	}
+
+	canvas := canvases.Get(image.Pt(size, size))
+	defer canvases.Put(canvas)
+	half := size / 2
+	for i, img := range children {
+		if img == nil {
+			continue
+		}
+		x, y := (i%2)*half, (i/2)*half
+		filter.Scale(canvas, image.Rect(x, y, x+half, y+half), img, img.Bounds(), draw.Over, nil)
+	}
+
+	buf := encodeBuffers.Get()
+	defer encodeBuffers.Put(buf)
+	if err := format.Encode(buf, canvas); err != nil {
+		return false, fmt.Errorf("failed to encode overview %s: %w", parent, err)
+	}
+	if err := target.MkdirAll(ctx, fmt.Sprintf("%d/%d/", parent.Z, parent.X)); err != nil {
+		return false, err
+	}
+	if err := target.PutFile(ctx, parent.String(), buf); err != nil {
+		return false, fmt.Errorf("failed to upload overview %s: %w", parent, err)
+	}
+	return true, nil
+}
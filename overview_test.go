@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+func TestBuildOverviews(t *testing.T) {
+	ctx := context.Background()
+	backend := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	red := color.RGBA{R: 0xff, A: 0xff}
+	// Only the top-left and bottom-right children of 1/0/0 exist
+	for _, tile := range []TileDescriptor{{Z: 2, X: 0, Y: 0, Format: "png"}, {Z: 2, X: 1, Y: 1, Format: "png"}} {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+3] = red.R, red.A
+		}
+		buf := new(bytes.Buffer)
+		require.NoError(t, png.Encode(buf, img))
+		require.NoError(t, backend.MkdirAll(ctx, "2/"+[]string{"0", "1"}[tile.X]))
+		require.NoError(t, backend.PutFile(ctx, tile.String(), buf))
+	}
+
+	built, err := buildOverviews(ctx, backend, []TileDescriptor{{Z: 2, X: 1, Y: 1, Format: "png"}}, 0, boxKernel, DefaultOutputFormat, 2, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, built)
+
+	f, err := backend.GetFile(ctx, "1/0/0.png")
+	require.NoError(t, err)
+	img, _, err := image.Decode(bytes.NewBuffer(f))
+	require.NoError(t, err)
+	assert.Equal(t, 4, img.Bounds().Dx())
+	assert.Equal(t, red, color.RGBAModel.Convert(img.At(0, 0)))
+	assert.Equal(t, red, color.RGBAModel.Convert(img.At(3, 3)))
+	assert.Equal(t, color.RGBA{}, color.RGBAModel.Convert(img.At(3, 0)))
+	assert.True(t, backend.FileExists(ctx, "0/0/0.png"))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PlanEntry describes what a run would do with a single target tile.
+type PlanEntry struct {
+	Tile string `json:"tile"`
+	// "create" or "overwrite"
+	Action string `json:"action"`
+	// Names of the candidate sources, in z-order (base layer first)
+	Sources []string `json:"sources"`
+}
+
+type PlanCounts struct {
+	Tiles     int `json:"tiles"`
+	Create    int `json:"create"`
+	Overwrite int `json:"overwrite"`
+}
+
+func (c *PlanCounts) add(action string) {
+	c.Tiles++
+	if action == "create" {
+		c.Create++
+	} else {
+		c.Overwrite++
+	}
+}
+
+type PlanSummary struct {
+	PlanCounts
+	Zoom map[int]*PlanCounts `json:"zoom"`
+	// Number of tiles each source is a candidate for
+	Sources map[string]int `json:"sources"`
+}
+
+// Plan is the result of -dry-run: what would be merged, without fetching or
+// decoding any tile.
+type Plan struct {
+	Tiles   []PlanEntry `json:"tiles"`
+	Summary PlanSummary `json:"summary"`
+}
+
+func newPlan() *Plan {
+	return &Plan{
+		Tiles: []PlanEntry{},
+		Summary: PlanSummary{
+			Zoom:    map[int]*PlanCounts{},
+			Sources: map[string]int{},
+		},
+	}
+}
+
+// Add appends a tile to the plan. exists tells whether the target has it.
+func (p *Plan) Add(tile TileDescriptor, sources []*TilesetDescriptor, exists bool) {
+	entry := PlanEntry{Tile: tile.String(), Action: "create", Sources: sourceNames(sources)}
+	if exists {
+		entry.Action = "overwrite"
+	}
+	p.Tiles = append(p.Tiles, entry)
+
+	p.Summary.add(entry.Action)
+	if p.Summary.Zoom[tile.Z] == nil {
+		p.Summary.Zoom[tile.Z] = &PlanCounts{}
+	}
+	p.Summary.Zoom[tile.Z].add(entry.Action)
+	for _, name := range entry.Sources {
+		p.Summary.Sources[name]++
+	}
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// WriteCSV writes one row per tile, the sources are separated by '|'.
+func (p *Plan) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"tile", "z", "action", "sources"}); err != nil {
+		return err
+	}
+	for _, entry := range p.Tiles {
+		z := entry.Tile[:strings.Index(entry.Tile, "/")]
+		if err := writer.Write([]string{entry.Tile, z, entry.Action, strings.Join(entry.Sources, "|")}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// SummaryLines renders the summary for humans.
+func (p *Plan) SummaryLines() []string {
+	lines := []string{fmt.Sprintf("%d tiles: %d to create, %d to overwrite", p.Summary.Tiles, p.Summary.Create, p.Summary.Overwrite)}
+	zooms := make([]int, 0, len(p.Summary.Zoom))
+	for z := range p.Summary.Zoom {
+		zooms = append(zooms, z)
+	}
+	sort.Ints(zooms)
+	for _, z := range zooms {
+		c := p.Summary.Zoom[z]
+		lines = append(lines, fmt.Sprintf("zoom %d: %d tiles, %d to create, %d to overwrite", z, c.Tiles, c.Create, c.Overwrite))
+	}
+	names := make([]string, 0, len(p.Summary.Sources))
+	for name := range p.Summary.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("source %s: candidate for %d tiles", name, p.Summary.Sources[name]))
+	}
+	return lines
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	base := &TilesetDescriptor{Name: "base"}
+	overlay := &TilesetDescriptor{Name: "overlay#opacity=0.5"}
+	plan := newPlan()
+	plan.Add(TileDescriptor{Z: 1, X: 0, Y: 0, Format: "png"}, []*TilesetDescriptor{base}, false)
+	plan.Add(TileDescriptor{Z: 2, X: 0, Y: 9, Format: "png"}, []*TilesetDescriptor{base, overlay}, true)
+	plan.Add(TileDescriptor{Z: 2, X: 0, Y: 10, Format: "png"}, []*TilesetDescriptor{overlay}, false)
+	plan.Add(TileDescriptor{Z: 2, X: 1, Y: 0, Format: "png"}, []*TilesetDescriptor{base, overlay}, false)
+
+	var tiles []string
+	for _, entry := range plan.Tiles {
+		tiles = append(tiles, entry.Tile)
+	}
+	assert.Equal(t, []string{"1/0/0.png", "2/0/9.png", "2/0/10.png", "2/1/0.png"}, tiles)
+	assert.Equal(t, PlanEntry{Tile: "2/0/9.png", Action: "overwrite", Sources: []string{"base", "overlay#opacity=0.5"}}, plan.Tiles[1])
+	assert.Equal(t, PlanCounts{Tiles: 4, Create: 3, Overwrite: 1}, plan.Summary.PlanCounts)
+	assert.Equal(t, &PlanCounts{Tiles: 3, Create: 2, Overwrite: 1}, plan.Summary.Zoom[2])
+	assert.Equal(t, map[string]int{"base": 3, "overlay#opacity=0.5": 3}, plan.Summary.Sources)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, plan.WriteCSV(buf))
+	assert.Equal(t, "tile,z,action,sources\n"+
+		"1/0/0.png,1,create,base\n"+
+		"2/0/9.png,2,overwrite,base|overlay#opacity=0.5\n"+
+		"2/0/10.png,2,create,overlay#opacity=0.5\n"+
+		"2/1/0.png,2,create,base|overlay#opacity=0.5\n", buf.String())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"sync"
+	"sync/atomic"
+)
+
+// canvasPool hands out cleared RGBA canvases, reusing the ones which have been
+// put back. Tiles of different sizes get separate pools.
+type canvasPool struct {
+	pools     sync.Map // image.Point -> *sync.Pool
+	allocated int64
+	reused    int64
+}
+
+func (p *canvasPool) Get(size image.Point) *image.RGBA {
+	pool, _ := p.pools.LoadOrStore(size, &sync.Pool{})
+	if canvas, ok := pool.(*sync.Pool).Get().(*image.RGBA); ok {
+		atomic.AddInt64(&p.reused, 1)
+		for i := range canvas.Pix {
+			canvas.Pix[i] = 0
+		}
+		return canvas
+	}
+	atomic.AddInt64(&p.allocated, 1)
+	return image.NewRGBA(image.Rectangle{Max: size})
+}
+
+// Stats returns how many canvases have been allocated and reused so far.
+func (p *canvasPool) Stats() (allocated, reused int64) {
+	return atomic.LoadInt64(&p.allocated), atomic.LoadInt64(&p.reused)
+}
+
+// Put returns a canvas to the pool, it must not be used afterwards.
+func (p *canvasPool) Put(canvas *image.RGBA) {
+	pool, _ := p.pools.LoadOrStore(canvas.Rect.Size(), &sync.Pool{})
+	pool.(*sync.Pool).Put(canvas)
+}
+
+// bufferPool hands out empty buffers, e.g. for encoding tiles.
+type bufferPool struct {
+	pool      sync.Pool
+	allocated int64
+	reused    int64
+}
+
+func (p *bufferPool) Get() *bytes.Buffer {
+	if buf, ok := p.pool.Get().(*bytes.Buffer); ok {
+		atomic.AddInt64(&p.reused, 1)
+		buf.Reset()
+		return buf
+	}
+	atomic.AddInt64(&p.allocated, 1)
+	return new(bytes.Buffer)
+}
+
+// Stats returns how many buffers have been allocated and reused so far.
+func (p *bufferPool) Stats() (allocated, reused int64) {
+	return atomic.LoadInt64(&p.allocated), atomic.LoadInt64(&p.reused)
+}
+
+// Put returns a buffer to the pool, it must not be used afterwards.
+func (p *bufferPool) Put(buf *bytes.Buffer) {
+	p.pool.Put(buf)
+}
+
+var (
+	canvases      canvasPool
+	encodeBuffers bufferPool
+)
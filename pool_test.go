@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanvasPool(t *testing.T) {
+	var pool canvasPool
+	canvas := pool.Get(image.Pt(4, 4))
+	assert.Equal(t, image.Rect(0, 0, 4, 4), canvas.Bounds())
+	canvas.Set(1, 1, color.White)
+	pool.Put(canvas)
+
+	// Whether or not the canvas is reused, it must be empty
+	canvas = pool.Get(image.Pt(4, 4))
+	assert.Equal(t, color.RGBA{}, canvas.At(1, 1))
+	assert.Equal(t, image.Rect(0, 0, 8, 8), pool.Get(image.Pt(8, 8)).Bounds())
+	allocated, reused := pool.Stats()
+	assert.Equal(t, int64(3), allocated+reused)
+}
+
+func TestMergeReusesBuffers(t *testing.T) {
+	ctx := context.Background()
+	tile := TileDescriptor{Z: 0, X: 0, Y: 0, Format: "png"}
+	red := testTileset(t, "red", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	green := testTileset(t, "green", 256, 128, color.NRGBA{G: 0xff, A: 0xff})
+	blue := testTileset(t, "blue", 256, 64, color.NRGBA{B: 0xff, A: 0xff})
+
+	merger := &Merger{}
+	first, err := merger.Merge(ctx, tile, []*TilesetDescriptor{red, green}, nil)
+	require.NoError(t, err)
+	snapshot := append([]byte(nil), first...)
+	second, err := merger.Merge(ctx, tile, []*TilesetDescriptor{red, blue}, nil)
+	require.NoError(t, err)
+
+	// Results must not share the pooled buffers
+	assert.Equal(t, snapshot, first)
+	img, _, err := image.Decode(bytes.NewReader(second))
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA{B: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(0, 0)))
+	// No leftovers of the first merge on the reused canvas
+	assert.Equal(t, color.RGBA{R: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(100, 0)))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// tileRange is an inclusive range of tile columns and rows on one zoom level.
+type tileRange struct {
+	MinX, MaxX, MinY, MaxY int
+}
+
+func (r tileRange) contains(x, y int) bool {
+	return x >= r.MinX && x <= r.MaxX && y >= r.MinY && y <= r.MaxY
+}
+
+func (r tileRange) intersect(o tileRange) tileRange {
+	return tileRange{
+		MinX: maxInt(r.MinX, o.MinX), MaxX: minInt(r.MaxX, o.MaxX),
+		MinY: maxInt(r.MinY, o.MinY), MaxY: minInt(r.MaxY, o.MaxY),
+	}
+}
+
+func (r tileRange) empty() bool {
+	return r.MinX > r.MaxX || r.MinY > r.MaxY
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Region restricts a merge to a part of the tile grid: a lon/lat bounding box
+// and/or explicit tile ranges per zoom level. A nil Region contains all tiles.
+type Region struct {
+	// minLon, minLat, maxLon, maxLat
+	bbox *[4]float64
+	// if set, only the zoom levels listed are part of the region
+	ranges map[int]tileRange
+}
+
+// NewRegion parses the -bbox ('minLon,minLat,maxLon,maxLat') and -range
+// ('z/minX-maxX/minY-maxY') options. It returns nil if neither is set.
+func NewRegion(bbox string, ranges []string) (*Region, error) {
+	if len(bbox) == 0 && len(ranges) == 0 {
+		return nil, nil
+	}
+	r := &Region{}
+	if len(bbox) > 0 {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid bbox %s, expected minLon,minLat,maxLon,maxLat", bbox)
+		}
+		var values [4]float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bbox %s: %w", bbox, err)
+			}
+			values[i] = v
+		}
+		if values[0] >= values[2] || values[1] >= values[3] {
+			return nil, fmt.Errorf("invalid bbox %s, min must be smaller than max", bbox)
+		}
+		r.bbox = &values
+	}
+	if len(ranges) > 0 {
+		r.ranges = map[int]tileRange{}
+		for _, spec := range ranges {
+			z, tr, err := parseTileRange(spec)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := r.ranges[z]; ok {
+				return nil, fmt.Errorf("duplicate range for zoom level %d", z)
+			}
+			r.ranges[z] = tr
+		}
+	}
+	return r, nil
+}
+
+// parseTileRange parses 'z/minX-maxX/minY-maxY'; single columns or rows can
+// be given as 'x' instead of 'x-x'.
+func parseTileRange(spec string) (int, tileRange, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 {
+		return 0, tileRange{}, fmt.Errorf("invalid range %s, expected z/minX-maxX/minY-maxY", spec)
+	}
+	z, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, tileRange{}, fmt.Errorf("invalid range %s: %w", spec, err)
+	}
+	bounds := make([]int, 0, 4)
+	for _, part := range parts[1:] {
+		minMax := strings.SplitN(part, "-", 2)
+		if len(minMax) == 1 {
+			minMax = append(minMax, minMax[0])
+		}
+		for _, v := range minMax {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, tileRange{}, fmt.Errorf("invalid range %s: %w", spec, err)
+			}
+			bounds = append(bounds, n)
+		}
+	}
+	tr := tileRange{MinX: bounds[0], MaxX: bounds[1], MinY: bounds[2], MaxY: bounds[3]}
+	if tr.empty() {
+		return 0, tileRange{}, fmt.Errorf("invalid range %s, min must not be larger than max", spec)
+	}
+	return z, tr, nil
+}
+
+// bboxRange returns the tiles on zoom level z touched by the bounding box.
+func (r *Region) bboxRange(z int) tileRange {
+	n := float64(int(1) << uint(z))
+	min := lonLatToPoint(r.bbox[0], r.bbox[3])
+	max := lonLatToPoint(r.bbox[2], r.bbox[1])
+	last := int(n) - 1
+	return tileRange{
+		MinX: minInt(maxInt(int(math.Floor(min.X*n)), 0), last),
+		MaxX: minInt(maxInt(int(math.Ceil(max.X*n))-1, 0), last),
+		MinY: minInt(maxInt(int(math.Floor(min.Y*n)), 0), last),
+		MaxY: minInt(maxInt(int(math.Ceil(max.Y*n))-1, 0), last),
+	}
+}
+
+// Contains reports whether the tile z/x/y is part of the region.
+func (r *Region) Contains(z, x, y int) bool {
+	if r == nil {
+		return true
+	}
+	if r.bbox != nil && !r.bboxRange(z).contains(x, y) {
+		return false
+	}
+	if r.ranges != nil {
+		tr, ok := r.ranges[z]
+		return ok && tr.contains(x, y)
+	}
+	return true
+}
+
+// envelope returns a range on zoom level z covering all tiles which are part
+// of the region or have descendants in it (needed for overzoomed sources). ok
+// is false if there are none.
+func (r *Region) envelope(z int) (tileRange, bool) {
+	var result tileRange
+	if r.ranges != nil {
+		found := false
+		for rz, tr := range r.ranges {
+			if rz < z {
+				continue
+			}
+			shift := uint(rz - z)
+			shifted := tileRange{tr.MinX >> shift, tr.MaxX >> shift, tr.MinY >> shift, tr.MaxY >> shift}
+			if !found {
+				result = shifted
+				found = true
+				continue
+			}
+			result = tileRange{
+				MinX: minInt(result.MinX, shifted.MinX), MaxX: maxInt(result.MaxX, shifted.MaxX),
+				MinY: minInt(result.MinY, shifted.MinY), MaxY: maxInt(result.MaxY, shifted.MaxY),
+			}
+		}
+		if !found {
+			return result, false
+		}
+	} else {
+		result = tileRange{MinX: 0, MaxX: math.MaxInt32, MinY: 0, MaxY: math.MaxInt32}
+	}
+	if r.bbox != nil {
+		result = result.intersect(r.bboxRange(z))
+	}
+	return result, !result.empty()
+}
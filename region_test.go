@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegion(t *testing.T) {
+	var none *Region
+	assert.True(t, none.Contains(3, 1, 2))
+
+	region, err := NewRegion("", nil)
+	require.NoError(t, err)
+	assert.Nil(t, region)
+
+	// Roughly Bavaria
+	region, err = NewRegion("9,47,14,50.5", nil)
+	require.NoError(t, err)
+	assert.True(t, region.Contains(0, 0, 0))
+	assert.True(t, region.Contains(8, 137, 89))
+	assert.False(t, region.Contains(8, 137, 95))
+	assert.False(t, region.Contains(8, 10, 89))
+
+	region, err = NewRegion("", []string{"8/136-137/88-89", "9/274/178"})
+	require.NoError(t, err)
+	assert.True(t, region.Contains(8, 136, 89))
+	assert.False(t, region.Contains(8, 138, 89))
+	assert.True(t, region.Contains(9, 274, 178))
+	assert.False(t, region.Contains(9, 274, 179))
+	// Zoom levels without a range aren't part of the region
+	assert.False(t, region.Contains(7, 68, 44))
+	env, ok := region.envelope(7)
+	assert.True(t, ok)
+	assert.Equal(t, tileRange{68, 68, 44, 44}, env)
+	_, ok = region.envelope(10)
+	assert.False(t, ok)
+
+	for _, invalid := range []string{"8/1-2", "8/2-1/0-0", "a/1/1", "8/1-x/1"} {
+		_, err = NewRegion("", []string{invalid})
+		assert.Error(t, err, invalid)
+	}
+	_, err = NewRegion("", []string{"8/1/1", "8/2/2"})
+	assert.Error(t, err)
+	_, err = NewRegion("14,47,9,50", nil)
+	assert.Error(t, err)
+	_, err = NewRegion("1,2,3", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Stages a tile can fail in
+const (
+	stageFetch   = "fetch"
+	stageDecode  = "decode"
+	stageCompose = "compose"
+	stageEncode  = "encode"
+	stageUpload  = "upload"
+)
+
+// TileError describes why (a source of) a tile couldn't be merged.
+type TileError struct {
+	Tile TileDescriptor
+	// Name of the source, empty if the error isn't specific to one
+	Source string
+	Stage  string
+	Err    error
+}
+
+func (e *TileError) Error() string {
+	if len(e.Source) == 0 {
+		return fmt.Sprintf("failed to %s %s: %v", e.Stage, e.Tile, e.Err)
+	}
+	return fmt.Sprintf("failed to %s %s from %s: %v", e.Stage, e.Tile, e.Source, e.Err)
+}
+
+func (e *TileError) Unwrap() error {
+	return e.Err
+}
+
+type Failure struct {
+	Tile   string `json:"tile"`
+	Source string `json:"source,omitempty"`
+	Stage  string `json:"stage"`
+	Error  string `json:"error"`
+}
+
+type FailureSummary struct {
+	// Number of tiles with at least one failure
+	Tiles   int            `json:"tiles"`
+	Stages  map[string]int `json:"stages"`
+	Sources map[string]int `json:"sources"`
+	// Backend operations which were retried during the run, failed or not
+	Retries int64 `json:"retries"`
+}
+
+// FailureReport collects the failures of a run, so the affected tiles can be
+// merged again with -rerun.
+type FailureReport struct {
+	Failures []Failure      `json:"failures"`
+	Summary  FailureSummary `json:"summary"`
+	// Retry provides the number of retries for the summary, if set
+	Retry *RetryPolicy `json:"-"`
+
+	mu sync.Mutex
+}
+
+// Add records err, which is a *TileError unless it is about tile as a whole
+// (then stage is used).
+func (r *FailureReport) Add(tile TileDescriptor, stage string, err error) {
+	failure := Failure{Tile: tile.String(), Stage: stage, Error: err.Error()}
+	if tileErr, ok := err.(*TileError); ok {
+		failure.Source, failure.Stage = tileErr.Source, tileErr.Stage
+	}
+	r.mu.Lock()
+	r.Failures = append(r.Failures, failure)
+	r.mu.Unlock()
+}
+
+// Tiles returns the distinct tiles which failed, in order.
+func (r *FailureReport) Tiles() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[string]bool{}
+	var tiles []string
+	for _, failure := range r.Failures {
+		if !seen[failure.Tile] {
+			seen[failure.Tile] = true
+			tiles = append(tiles, failure.Tile)
+		}
+	}
+	sort.Strings(tiles)
+	return tiles
+}
+
+// Save writes the report including its summary to a local file.
+func (r *FailureReport) Save(path string) error {
+	tiles := r.Tiles()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Summary = FailureSummary{Tiles: len(tiles), Stages: map[string]int{}, Sources: map[string]int{}}
+	if r.Retry != nil {
+		r.Summary.Retries = r.Retry.Retries()
+	}
+	for _, failure := range r.Failures {
+		r.Summary.Stages[failure.Stage]++
+		if len(failure.Source) > 0 {
+			r.Summary.Sources[failure.Source]++
+		}
+	}
+	if r.Failures == nil {
+		r.Failures = []Failure{}
+	}
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+func LoadFailureReport(path string) (*FailureReport, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &FailureReport{}
+	if err := json.Unmarshal(content, r); err != nil {
+		return nil, fmt.Errorf("invalid failure report %s: %w", path, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureReport(t *testing.T) {
+	report := &FailureReport{Retry: &RetryPolicy{retries: 3}}
+	tile := TileDescriptor{Z: 8, X: 136, Y: 90, Format: "png"}
+	report.Add(tile, stageCompose, &TileError{tile, "scene", stageFetch, errors.New("timeout")})
+	report.Add(tile, stageUpload, errors.New("disk full"))
+	report.Add(TileDescriptor{Z: 8, X: 136, Y: 89, Format: "png"}, stageUpload, errors.New("disk full"))
+	assert.Equal(t, Failure{Tile: "8/136/90.png", Source: "scene", Stage: stageFetch, Error: "failed to fetch 8/136/90.png from scene: timeout"}, report.Failures[0])
+	assert.Equal(t, Failure{Tile: "8/136/90.png", Stage: stageUpload, Error: "disk full"}, report.Failures[1])
+	assert.Equal(t, []string{"8/136/89.png", "8/136/90.png"}, report.Tiles())
+
+	path := filepath.Join(t.TempDir(), "failures.json")
+	require.NoError(t, report.Save(path))
+	loaded, err := LoadFailureReport(path)
+	require.NoError(t, err)
+	assert.Equal(t, report.Failures, loaded.Failures)
+	assert.Equal(t, FailureSummary{
+		Tiles:   2,
+		Stages:  map[string]int{stageFetch: 1, stageUpload: 2},
+		Sources: map[string]int{"scene": 1},
+		Retries: 3,
+	}, loaded.Summary)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// boxKernel averages all source pixels covered by a destination pixel when
+// downsampling (like gdaladdo's "average").
+var boxKernel = &draw.Kernel{Support: 0.5, At: func(t float64) float64 {
+	if math.Abs(t) < 0.5 {
+		return 1
+	}
+	return 0
+}}
+
+var interpolators = map[string]draw.Interpolator{
+	"nearest":    draw.NearestNeighbor,
+	"box":        boxKernel,
+	"bilinear":   draw.BiLinear,
+	"catmullrom": draw.CatmullRom,
+}
+
+func interpolatorNames() string {
+	var names []string
+	for name := range interpolators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseInterpolator(name string) (draw.Interpolator, error) {
+	if interpolator, ok := interpolators[name]; ok {
+		return interpolator, nil
+	}
+	return nil, fmt.Errorf("unknown resampling filter %s, valid filters are: %s", name, interpolatorNames())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/minio/minio-go/v7"
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+// RetryPolicy configures how often and how patiently failed backend
+// operations are retried.
+type RetryPolicy struct {
+	// Attempts is the number of retries after the first failure (0 disables
+	// retrying).
+	Attempts int
+	// Backoff is the delay before the first retry, it doubles with every
+	// further one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes every delay by up to this fraction (0-1), so workers
+	// don't hammer a recovering server in lockstep.
+	Jitter float64
+
+	retries int64
+}
+
+// Retries returns the number of retries so far.
+func (p *RetryPolicy) Retries() int64 {
+	return atomic.LoadInt64(&p.retries)
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// do runs op until it succeeds, fails permanently or runs out of attempts.
+func (p *RetryPolicy) do(ctx context.Context, op func() error) error {
+	err := op()
+	for attempt := 0; attempt < p.Attempts && err != nil && retryable(ctx, err); attempt++ {
+		select {
+		case <-time.After(p.delay(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+		atomic.AddInt64(&p.retries, 1)
+		err = op()
+	}
+	return err
+}
+
+// retryable reports whether err is known to be transient: timeouts, dropped
+// connections, busy databases and 5xx or 429 responses. Anything else, like
+// missing files, denied requests, invalid paths or a full disk, is permanent.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var response minio.ErrorResponse
+	if errors.As(err, &response) {
+		return response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests ||
+			response.StatusCode == http.StatusRequestTimeout
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// retryBackend retries the failed operations of a backend according to a
+// policy.
+type retryBackend struct {
+	StorageBackend
+	policy *RetryPolicy
+}
+
+// versionedRetryBackend is a retryBackend for a VersionedBackend. Other
+// backends don't get GetFileVersion, so the caller hashes the content it
+// already has instead of having it fetched again.
+type versionedRetryBackend struct {
+	retryBackend
+}
+
+func withRetry(backend StorageBackend, policy *RetryPolicy) StorageBackend {
+	if policy == nil || policy.Attempts <= 0 {
+		return backend
+	}
+	if _, ok := backend.(VersionedBackend); ok {
+		return &versionedRetryBackend{retryBackend{backend, policy}}
+	}
+	return &retryBackend{backend, policy}
+}
+
+func (b *retryBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+func (b *retryBackend) GetDirectories(ctx context.Context, dirname string) (result []string, err error) {
+	err = b.policy.do(ctx, func() error {
+		result, err = b.StorageBackend.GetDirectories(ctx, dirname)
+		return err
+	})
+	return result, err
+}
+
+func (b *retryBackend) GetFiles(ctx context.Context, dirname string) (result []string, err error) {
+	err = b.policy.do(ctx, func() error {
+		result, err = b.StorageBackend.GetFiles(ctx, dirname)
+		return err
+	})
+	return result, err
+}
+
+func (b *retryBackend) GetFilesRecursive(ctx context.Context, dirname string) (result []string, err error) {
+	err = b.policy.do(ctx, func() error {
+		result, err = b.StorageBackend.GetFilesRecursive(ctx, dirname)
+		return err
+	})
+	return result, err
+}
+
+func (b *retryBackend) MkdirAll(ctx context.Context, dirname string) error {
+	return b.policy.do(ctx, func() error {
+		return b.StorageBackend.MkdirAll(ctx, dirname)
+	})
+}
+
+func (b *retryBackend) GetFile(ctx context.Context, filename string) (result []byte, err error) {
+	err = b.policy.do(ctx, func() error {
+		result, err = b.StorageBackend.GetFile(ctx, filename)
+		return err
+	})
+	return result, err
+}
+
+func (b *retryBackend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
+	// Backends may consume the buffer
+	data := content.Bytes()
+	return b.policy.do(ctx, func() error {
+		return b.StorageBackend.PutFile(ctx, filename, bytes.NewBuffer(data))
+	})
+}
+
+func (b *versionedRetryBackend) GetFileVersion(ctx context.Context, filename string) (version string, err error) {
+	err = b.policy.do(ctx, func() error {
+		version, err = b.StorageBackend.(VersionedBackend).GetFileVersion(ctx, filename)
+		return err
+	})
+	return version, err
+}
+
+// wrappedBackend is implemented by backends adding behavior to another one.
+type wrappedBackend interface {
+	Unwrap() StorageBackend
+}
+
+// baseBackend returns the backend at the bottom of all wrappers, for checking
+// its type and optional interfaces.
+func baseBackend(backend StorageBackend) StorageBackend {
+	for {
+		wrapped, ok := backend.(wrappedBackend)
+		if !ok {
+			return backend
+		}
+		backend = wrapped.Unwrap()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+// flakyBackend fails the first calls of GetFile and PutFile with err.
+type flakyBackend struct {
+	*FsBackend.FsBackend
+	failures int
+	err      error
+	calls    int
+}
+
+func (b *flakyBackend) GetFile(ctx context.Context, filename string) ([]byte, error) {
+	b.calls++
+	if b.calls <= b.failures {
+		return nil, b.err
+	}
+	return b.FsBackend.GetFile(ctx, filename)
+}
+
+func (b *flakyBackend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
+	b.calls++
+	if b.calls <= b.failures {
+		// Consume the buffer like an upload which broke off
+		content.Reset()
+		return b.err
+	}
+	return b.FsBackend.PutFile(ctx, filename, content)
+}
+
+func TestRetryBackend(t *testing.T) {
+	ctx := context.Background()
+	unavailable := minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}
+	policy := &RetryPolicy{Attempts: 2, MaxBackoff: maxRetryBackoff}
+	flaky := &flakyBackend{FsBackend: &FsBackend.FsBackend{BasePath: t.TempDir()}, failures: 2, err: unavailable}
+	backend := withRetry(flaky, policy)
+	assert.Equal(t, flaky, baseBackend(backend))
+
+	require.NoError(t, backend.PutFile(ctx, "0.png", bytes.NewBufferString("tile")))
+	assert.Equal(t, int64(2), policy.Retries())
+	content, err := backend.GetFile(ctx, "0.png")
+	require.NoError(t, err)
+	assert.Equal(t, "tile", string(content))
+
+	// Out of attempts
+	flaky.calls, flaky.failures = 0, 3
+	_, err = backend.GetFile(ctx, "0.png")
+	assert.Equal(t, unavailable, err)
+	assert.Equal(t, int64(4), policy.Retries())
+
+	// Permanent errors aren't retried
+	for _, permanent := range []error{minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, os.ErrNotExist, errors.New("invalid tile path")} {
+		flaky.calls, flaky.err = 0, permanent
+		_, err = backend.GetFile(ctx, "0.png")
+		assert.True(t, errors.Is(err, permanent))
+		assert.Equal(t, 1, flaky.calls)
+	}
+	assert.Equal(t, int64(4), policy.Retries())
+}
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	for _, err := range []error{
+		minio.ErrorResponse{Code: "InternalError", StatusCode: 500},
+		minio.ErrorResponse{Code: "SlowDown", StatusCode: 429},
+		&url.Error{Op: "Get", URL: "https://example.com/0/0/0.png", Err: timeoutError{}},
+		io.ErrUnexpectedEOF,
+		&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+		fmt.Errorf("upload: %w", syscall.EPIPE),
+		sqlite3.Error{Code: sqlite3.ErrBusy},
+	} {
+		assert.True(t, retryable(ctx, err), "%v", err)
+	}
+	for _, err := range []error{
+		minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403},
+		&os.PathError{Op: "open", Path: "0/0/0.png", Err: syscall.ENOENT},
+		&os.PathError{Op: "write", Path: "0/0/0.png", Err: syscall.ENOSPC},
+		&os.PathError{Op: "read", Path: "0/0/", Err: syscall.EISDIR},
+		sqlite3.Error{Code: sqlite3.ErrConstraint},
+		errors.New("directory nesting too deep"),
+	} {
+		assert.False(t, retryable(ctx, err), "%v", err)
+	}
+
+	// Nothing is retried once the run is aborted
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, retryable(cancelled, io.ErrUnexpectedEOF))
+}
+
+func TestRetryBackendVersions(t *testing.T) {
+	policy := &RetryPolicy{Attempts: 2, MaxBackoff: maxRetryBackoff}
+	fs := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	_, ok := withRetry(fs, policy).(VersionedBackend)
+	assert.True(t, ok)
+	// Only backends with versions of their own provide them
+	_, ok = withRetry(struct{ StorageBackend }{fs}, policy).(VersionedBackend)
+	assert.False(t, ok)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/v4lli/prioritile/MBTilesBackend"
+	"github.com/v4lli/prioritile/PMTilesBackend"
+	"github.com/v4lli/prioritile/TileMath"
+)
+
+// schemeTemplates are the predefined tile layouts. Templates may use {z},
+// {x}, {y}, {-y} (TMS, flipped y), {q} (quadkey) and {ext}.
+var schemeTemplates = map[string]string{
+	"xyz":     "{z}/{x}/{y}.{ext}",
+	"tms":     "{z}/{x}/{-y}.{ext}",
+	"quadkey": "{q}.{ext}",
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{(z|x|y|-y|q|ext)\}`)
+
+// tileScheme maps tiles to the paths of a layout and back.
+type tileScheme struct {
+	template string
+	pattern  *regexp.Regexp
+}
+
+// parseScheme accepts the name of a predefined scheme or a path template,
+// e.g. '{z}/{y}/{x}.png'.
+func parseScheme(spec string) (*tileScheme, error) {
+	template, ok := schemeTemplates[spec]
+	if !ok {
+		if !strings.Contains(spec, "{") {
+			return nil, fmt.Errorf("unknown scheme %s, expected xyz, tms, quadkey or a template like {z}/{y}/{x}.png", spec)
+		}
+		template = spec
+	}
+
+	seen := map[string]bool{}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, m := range templatePlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		name := template[m[2]:m[3]]
+		if seen[name] {
+			return nil, fmt.Errorf("invalid scheme %s, {%s} is used twice", spec, name)
+		}
+		seen[name] = true
+		switch name {
+		case "q":
+			pattern.WriteString(`(?P<q>[0-3]*)`)
+		case "ext":
+			pattern.WriteString(`(?P<ext>[A-Za-z0-9]+)`)
+		case "-y":
+			pattern.WriteString(`(?P<tmsy>\d+)`)
+		default:
+			pattern.WriteString(`(?P<` + name + `>\d+)`)
+		}
+		last = m[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]) + "$")
+
+	if !seen["q"] && !(seen["z"] && seen["x"] && (seen["y"] != seen["-y"])) {
+		return nil, fmt.Errorf("invalid scheme %s, either {q} or {z}, {x} and {y} (or {-y}) are required", spec)
+	}
+	if seen["q"] && (seen["z"] || seen["x"] || seen["y"] || seen["-y"]) {
+		return nil, fmt.Errorf("invalid scheme %s, {q} can't be combined with {z}, {x} or {y}", spec)
+	}
+	return &tileScheme{template: template, pattern: regexp.MustCompile(pattern.String())}, nil
+}
+
+func quadkey(z, x, y int) string {
+	var q strings.Builder
+	for i := z; i > 0; i-- {
+		digit := byte('0')
+		mask := 1 << uint(i-1)
+		if x&mask != 0 {
+			digit++
+		}
+		if y&mask != 0 {
+			digit += 2
+		}
+		q.WriteByte(digit)
+	}
+	return q.String()
+}
+
+// Path returns the location of a tile in the layout.
+func (s *tileScheme) Path(tile TileDescriptor) string {
+	return templatePlaceholder.ReplaceAllStringFunc(s.template, func(placeholder string) string {
+		switch placeholder {
+		case "{z}":
+			return strconv.Itoa(tile.Z)
+		case "{x}":
+			return strconv.Itoa(tile.X)
+		case "{y}":
+			return strconv.Itoa(tile.Y)
+		case "{-y}":
+			return strconv.Itoa(1<<uint(tile.Z) - 1 - tile.Y)
+		case "{q}":
+			return quadkey(tile.Z, tile.X, tile.Y)
+		default:
+			return tile.Format
+		}
+	})
+}
+
+// Tile parses a location in the layout, ok is false if it isn't a tile.
+func (s *tileScheme) Tile(filename string) (TileDescriptor, bool) {
+	m := s.pattern.FindStringSubmatch(filename)
+	if m == nil {
+		return TileDescriptor{}, false
+	}
+	var tile TileDescriptor
+	tmsY := -1
+	for i, name := range s.pattern.SubexpNames() {
+		if i == 0 || len(name) == 0 {
+			continue
+		}
+		if name == "ext" {
+			tile.Format = m[i]
+			continue
+		}
+		if name == "q" {
+			tile.Z = len(m[i])
+			for _, digit := range m[i] {
+				tile.X = tile.X<<1 | int(digit-'0')&1
+				tile.Y = tile.Y<<1 | int(digit-'0')>>1
+			}
+			continue
+		}
+		n, err := strconv.Atoi(m[i])
+		if err != nil {
+			return TileDescriptor{}, false
+		}
+		switch name {
+		case "z":
+			tile.Z = n
+		case "x":
+			tile.X = n
+		case "y":
+			tile.Y = n
+		case "tmsy":
+			tmsY = n
+		}
+	}
+	if tmsY >= 0 {
+		tile.Y = 1<<uint(tile.Z) - 1 - tmsY
+	}
+	if len(tile.Format) == 0 {
+		// The extension is part of the template
+		tile.Format = strings.TrimPrefix(path.Ext(filename), ".")
+	}
+	if tile.X >= 1<<uint(tile.Z) || tile.Y >= 1<<uint(tile.Z) || tile.Y < 0 {
+		return TileDescriptor{}, false
+	}
+	return tile, true
+}
+
+// zoomed reports whether the layout starts with {z}/ directories, so the
+// tiles can be listed one zoom level at a time.
+func (s *tileScheme) zoomed() bool {
+	return strings.HasPrefix(s.template, "{z}/")
+}
+
+// hierarchical reports whether the layout uses {z}/{x}/ directories, so
+// listings of single directories can be passed through.
+func (s *tileScheme) hierarchical() bool {
+	return strings.HasPrefix(s.template, "{z}/{x}/") && !strings.Contains(s.template[len("{z}/{x}/"):], "/")
+}
+
+// schemeBackend translates the {z}/{x}/{y}.{ext} paths used internally to the
+// tile layout of the wrapped backend. Other files (e.g. the manifest) are
+// passed through unchanged.
+type schemeBackend struct {
+	StorageBackend
+	scheme *tileScheme
+
+	// The last listing, see tiles
+	listingMu     sync.Mutex
+	listed        bool
+	listingPrefix string
+	listing       []string
+}
+
+// versionedSchemeBackend is a schemeBackend for a VersionedBackend, see
+// versionedRetryBackend.
+type versionedSchemeBackend struct {
+	schemeBackend
+}
+
+// withScheme wraps backend if it doesn't use the XYZ layout.
+func withScheme(backend StorageBackend, scheme string) (StorageBackend, error) {
+	if len(scheme) == 0 || scheme == "xyz" {
+		return backend, nil
+	}
+	switch baseBackend(backend).(type) {
+	case *MBTilesBackend.MBTilesBackend, *PMTilesBackend.PMTilesBackend:
+		return nil, fmt.Errorf("the scheme option only applies to directories and S3 buckets")
+	}
+	s, err := parseScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := backend.(VersionedBackend); ok {
+		return &versionedSchemeBackend{schemeBackend{StorageBackend: backend, scheme: s}}, nil
+	}
+	return &schemeBackend{StorageBackend: backend, scheme: s}, nil
+}
+
+func (b *schemeBackend) native(filename string) string {
+	tile, err := Str2Tile(filename)
+	if err != nil {
+		return filename
+	}
+	return b.scheme.Path(*tile)
+}
+
+func (b *schemeBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+func (b *schemeBackend) GetFile(ctx context.Context, filename string) ([]byte, error) {
+	return b.StorageBackend.GetFile(ctx, b.native(filename))
+}
+
+func (b *schemeBackend) PutFile(ctx context.Context, filename string, content *bytes.Buffer) error {
+	native := b.native(filename)
+	if dir := path.Dir(native); dir != "." {
+		if err := b.StorageBackend.MkdirAll(ctx, dir+"/"); err != nil {
+			return err
+		}
+	}
+	return b.StorageBackend.PutFile(ctx, native, content)
+}
+
+func (b *schemeBackend) FileExists(ctx context.Context, filename string) bool {
+	return b.StorageBackend.FileExists(ctx, b.native(filename))
+}
+
+// MkdirAll does nothing, the directories of the layout are created on PutFile.
+func (b *schemeBackend) MkdirAll(ctx context.Context, dirname string) error {
+	return nil
+}
+
+func (b *versionedSchemeBackend) GetFileVersion(ctx context.Context, filename string) (string, error) {
+	return b.StorageBackend.(VersionedBackend).GetFileVersion(ctx, b.native(filename))
+}
+
+// tiles lists the tiles of the wrapped backend below dirname, in internal
+// paths ordered by zoom level, column and row. Layouts starting with {z}/ are
+// listed one zoom level at a time, others (like quadkey) all at once. The last
+// listing is kept, so the columns of a zoom level don't list it again.
+func (b *schemeBackend) tiles(ctx context.Context, dirname string) ([]string, error) {
+	prefix := ""
+	if b.scheme.zoomed() {
+		if z, _, err := TileMath.ParseDir(dirname); err == nil && z >= 0 {
+			prefix = fmt.Sprintf("%d/", z)
+		}
+	}
+	b.listingMu.Lock()
+	defer b.listingMu.Unlock()
+	if b.listed && b.listingPrefix == prefix {
+		return b.listing, nil
+	}
+
+	files, err := b.StorageBackend.GetFilesRecursive(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var tiles []TileDescriptor
+	for _, f := range files {
+		if tile, ok := b.scheme.Tile(prefix + f); ok {
+			tiles = append(tiles, tile)
+		}
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].Z != tiles[j].Z {
+			return tiles[i].Z < tiles[j].Z
+		}
+		if tiles[i].X != tiles[j].X {
+			return tiles[i].X < tiles[j].X
+		}
+		return tiles[i].Y < tiles[j].Y
+	})
+	b.listing = make([]string, len(tiles))
+	for i, tile := range tiles {
+		b.listing[i] = tile.String()
+	}
+	b.listed, b.listingPrefix = true, prefix
+	return b.listing, nil
+}
+
+func (b *schemeBackend) GetFilesRecursive(ctx context.Context, dirname string) ([]string, error) {
+	tiles, err := b.tiles(ctx, dirname)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, tile := range tiles {
+		if strings.HasPrefix(tile, dirname) {
+			result = append(result, tile[len(dirname):])
+		}
+	}
+	return result, nil
+}
+
+func (b *schemeBackend) GetDirectories(ctx context.Context, dirname string) ([]string, error) {
+	if b.scheme.hierarchical() {
+		return b.StorageBackend.GetDirectories(ctx, dirname)
+	}
+	if b.scheme.zoomed() && len(dirname) == 0 {
+		// The zoom levels are the top directories
+		dirs, err := b.StorageBackend.GetDirectories(ctx, dirname)
+		if err != nil {
+			return nil, err
+		}
+		var result []string
+		for _, dir := range dirs {
+			if _, err := strconv.Atoi(dir); err == nil {
+				result = append(result, dir)
+			}
+		}
+		return result, nil
+	}
+	files, err := b.GetFilesRecursive(ctx, dirname)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, f := range files {
+		if idx := strings.Index(f, "/"); idx > 0 && (len(result) == 0 || result[len(result)-1] != f[:idx]) {
+			result = append(result, f[:idx])
+		}
+	}
+	return result, nil
+}
+
+func (b *schemeBackend) GetFiles(ctx context.Context, dirname string) ([]string, error) {
+	if b.scheme.hierarchical() {
+		files, err := b.StorageBackend.GetFiles(ctx, dirname)
+		if err != nil {
+			return nil, err
+		}
+		var result []string
+		for _, f := range files {
+			if tile, ok := b.scheme.Tile(dirname + f); ok {
+				result = append(result, path.Base(tile.String()))
+			}
+		}
+		return result, nil
+	}
+	files, err := b.GetFilesRecursive(ctx, dirname)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, f := range files {
+		if !strings.Contains(f, "/") {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
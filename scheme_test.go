@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+func TestTileScheme(t *testing.T) {
+	tile := TileDescriptor{Z: 3, X: 3, Y: 5, Format: "png"}
+	for spec, expected := range map[string]string{
+		"xyz":                      "3/3/5.png",
+		"tms":                      "3/3/2.png",
+		"quadkey":                  "213.png",
+		"{z}/{y}/{x}.png":          "3/5/3.png",
+		"tiles_{z}_{x}_{-y}.{ext}": "tiles_3_3_2.png",
+	} {
+		scheme, err := parseScheme(spec)
+		require.NoError(t, err, spec)
+		assert.Equal(t, expected, scheme.Path(tile), spec)
+		parsed, ok := scheme.Tile(expected)
+		assert.True(t, ok, spec)
+		assert.Equal(t, tile, parsed, spec)
+	}
+
+	scheme, err := parseScheme("tms")
+	require.NoError(t, err)
+	_, ok := scheme.Tile("openlayers.html")
+	assert.False(t, ok)
+	_, ok = scheme.Tile("3/3/8.png")
+	assert.False(t, ok)
+
+	for _, invalid := range []string{"bing", "{z}/{x}.png", "{z}/{x}/{y}/{y}.png", "{q}/{z}.png", "{z}/{x}/{y}-{-y}.png"} {
+		_, err = parseScheme(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSchemeBackend(t *testing.T) {
+	ctx := context.Background()
+	fs := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	backend, err := withScheme(fs, "quadkey")
+	require.NoError(t, err)
+	for _, tile := range []string{"3/3/5.png", "3/2/5.png", "2/1/2.png"} {
+		require.NoError(t, backend.PutFile(ctx, tile, bytes.NewBufferString(tile)))
+	}
+	assert.True(t, fs.FileExists(ctx, "213.png"))
+	assert.True(t, backend.FileExists(ctx, "3/3/5.png"))
+	content, err := backend.GetFile(ctx, "3/2/5.png")
+	require.NoError(t, err)
+	assert.Equal(t, "3/2/5.png", string(content))
+
+	files, err := backend.GetFilesRecursive(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2/1/2.png", "3/2/5.png", "3/3/5.png"}, files)
+	dirs, err := backend.GetDirectories(ctx, "3/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, dirs)
+	files, err = backend.GetFiles(ctx, "3/3/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"5.png"}, files)
+
+	backend, err = withScheme(fs, "xyz")
+	require.NoError(t, err)
+	assert.Equal(t, fs, backend)
+}
+
+func TestSchemeBackendVersions(t *testing.T) {
+	ctx := context.Background()
+	fs := &FsBackend.FsBackend{BasePath: t.TempDir()}
+	backend, err := withScheme(fs, "tms")
+	require.NoError(t, err)
+	require.NoError(t, backend.PutFile(ctx, "1/0/0.png", bytes.NewBufferString("tile")))
+	versioned, ok := backend.(VersionedBackend)
+	require.True(t, ok)
+	version, err := versioned.GetFileVersion(ctx, "1/0/0.png")
+	require.NoError(t, err)
+	expected, err := fs.GetFileVersion(ctx, "1/0/1.png")
+	require.NoError(t, err)
+	assert.Equal(t, expected, version)
+
+	// Only backends with versions of their own provide them
+	backend, err = withScheme(struct{ StorageBackend }{fs}, "tms")
+	require.NoError(t, err)
+	_, ok = backend.(VersionedBackend)
+	assert.False(t, ok)
+}
+
+// listingBackend records the directories listed recursively.
+type listingBackend struct {
+	*FsBackend.FsBackend
+	listed []string
+}
+
+func (b *listingBackend) GetFilesRecursive(ctx context.Context, dirname string) ([]string, error) {
+	b.listed = append(b.listed, dirname)
+	return b.FsBackend.GetFilesRecursive(ctx, dirname)
+}
+
+func TestSchemeBackendZoomLevels(t *testing.T) {
+	ctx := context.Background()
+	fs := &listingBackend{FsBackend: &FsBackend.FsBackend{BasePath: t.TempDir()}}
+	backend, err := withScheme(fs, "{z}/{y}/{x}.png")
+	require.NoError(t, err)
+	for _, tile := range []string{"3/3/5.png", "3/2/5.png", "3/2/1.png", "2/1/2.png"} {
+		require.NoError(t, backend.PutFile(ctx, tile, bytes.NewBufferString(tile)))
+	}
+
+	dirs, err := backend.GetDirectories(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, dirs)
+	assert.Empty(t, fs.listed)
+
+	// Only the zoom level is listed, once for all of its columns
+	dirs, err = backend.GetDirectories(ctx, "3/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, dirs)
+	files, err := backend.GetFiles(ctx, "3/2/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.png", "5.png"}, files)
+	files, err = backend.GetFiles(ctx, "3/3/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"5.png"}, files)
+	assert.Equal(t, []string{"3/"}, fs.listed)
+
+	files, err = backend.GetFiles(ctx, "2/1/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.png"}, files)
+	assert.Equal(t, []string{"3/", "2/"}, fs.listed)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v4lli/prioritile/TileMath"
+)
+
+// tileCache is a simple LRU cache of merged tiles. Empty results are cached as
+// well, so tiles without data aren't merged over and over again.
+type tileCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // most recently used first
+	items    map[string]*list.Element
+}
+
+type cachedTile struct {
+	key     string
+	content []byte
+	etag    string
+}
+
+func newTileCache(capacity int) *tileCache {
+	return &tileCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (c *tileCache) Get(key string) (*cachedTile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*cachedTile), true
+	}
+	return nil, false
+}
+
+func (c *tileCache) Add(tile *cachedTile) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[tile.key]; ok {
+		e.Value = tile
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[tile.key] = c.order.PushFront(tile)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedTile).key)
+	}
+}
+
+// tileServer merges tiles on demand instead of precomputing the target.
+type tileServer struct {
+	merger  *Merger
+	format  *OutputFormat
+	sources []*TilesetDescriptor
+	cache   *tileCache
+	// extent of the available tiles, for TileJSON
+	minZ, maxZ int
+	bounds     [4]float64
+}
+
+func newTileServer(sources []TilesetDescriptor, merger *Merger, cacheSize int) *tileServer {
+	s := &tileServer{
+		merger:  merger,
+		format:  merger.Format,
+		sources: tilesetPointers(sources),
+		cache:   newTileCache(cacheSize),
+		minZ:    math.MaxInt32,
+		maxZ:    -1,
+	}
+	if s.format == nil {
+		s.format = DefaultOutputFormat
+	}
+
+	// Bounds are derived from the tiles on the highest zoom level the sources
+	// have, overzoomed sources extend the zoom levels further
+	nativeMaxZ := -1
+	minX, minY, maxX, maxY := math.MaxInt32, math.MaxInt32, -1, -1
+	for _, tileset := range s.sources {
+		tileset.buildIndex()
+		for _, tile := range tileset.GetTiles() {
+			if !tileset.Covers(tile) {
+				continue
+			}
+			if tile.Z < s.minZ {
+				s.minZ = tile.Z
+			}
+			if tile.Z+tileset.Options.Overzoom > s.maxZ {
+				s.maxZ = tile.Z + tileset.Options.Overzoom
+			}
+			if tile.Z > nativeMaxZ {
+				nativeMaxZ = tile.Z
+				minX, minY, maxX, maxY = math.MaxInt32, math.MaxInt32, -1, -1
+			}
+			if tile.Z < nativeMaxZ {
+				continue
+			}
+			if tile.X < minX {
+				minX = tile.X
+			}
+			if tile.X > maxX {
+				maxX = tile.X
+			}
+			if tile.Y < minY {
+				minY = tile.Y
+			}
+			if tile.Y > maxY {
+				maxY = tile.Y
+			}
+		}
+	}
+	if maxX >= 0 {
+		s.bounds = [4]float64{TileMath.Tile2Lon(minX, nativeMaxZ), TileMath.Tile2Lat(maxY+1, nativeMaxZ), TileMath.Tile2Lon(maxX+1, nativeMaxZ), TileMath.Tile2Lat(minY, nativeMaxZ)}
+	}
+	return s
+}
+
+// tileSources returns the sources which cover tile, with the same lookup as
+// the batch mode: a source contributes its tile or, if it's overzoomed, the
+// nearest ancestor.
+func (s *tileServer) tileSources(tile TileDescriptor) []*TilesetDescriptor {
+	var result []*TilesetDescriptor
+	for _, tileset := range s.sources {
+		if _, ok := tileset.Resolve(tile); ok && tileset.Covers(tile) {
+			result = append(result, tileset)
+		}
+	}
+	return result
+}
+
+func (s *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "tile.json" {
+		s.serveTileJSON(w, r)
+		return
+	}
+
+	tile, err := Str2Tile(path)
+	if err != nil || tile.Format != s.format.Ext() {
+		http.NotFound(w, r)
+		return
+	}
+
+	cached, ok := s.cache.Get(tile.String())
+	if !ok {
+		content, err := s.merger.Merge(r.Context(), *tile, s.tileSources(*tile), nil)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "could not merge tile", http.StatusInternalServerError)
+			return
+		}
+		cached = &cachedTile{key: tile.String(), content: content}
+		if content != nil {
+			cached.etag = `"` + contentHash(content) + `"`
+		}
+		s.cache.Add(cached)
+	}
+
+	if cached.content == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", cached.etag)
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, etag := range strings.Split(match, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == cached.etag || etag == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", s.format.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(cached.content)))
+	w.Write(cached.content)
+}
+
+func (s *tileServer) serveTileJSON(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	tileJSON := map[string]interface{}{
+		"tilejson": "3.0.0",
+		"name":     "prioritile",
+		"scheme":   "xyz",
+		"tiles":    []string{fmt.Sprintf("%s://%s/{z}/{x}/{y}.%s", scheme, r.Host, s.format.Ext())},
+		"minzoom":  s.minZ,
+		"maxzoom":  s.maxZ,
+		"bounds":   s.bounds,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tileJSON)
+}
+
+// serve implements the "serve" subcommand.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "Address to listen on")
+	cacheSize := flags.Int("cache", 4096, "Number of merged tiles to keep in the LRU cache")
+	bestEffort := flags.Bool("best-effort", false, "Best-effort merging: ignore erroneous tilesets completely and skip single failed source tiles.")
+	timeout := flags.Int("timeout", 60, "Configure the timeout for S3 disk backend operations (timeout in seconds)")
+	retries := flags.Int("retries", 3, "Number of retries of backend operations which failed with a transient error, 0 to disable")
+	format := flags.String("format", "png", "Format of the served tiles: png, jpeg, webp or webp-lossless")
+	quality := flags.Int("quality", 90, "Quality (0-100) for jpeg and webp tiles")
+	background := flags.String("background", "", "Color (RRGGBB) transparent pixels are painted onto for jpeg tiles")
+	configPath := flags.String("config", "", "JSON file listing additional sources (with their options), which are stacked on top of the ones given as arguments")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: prioritile serve [-listen=:8080] [-cache=4096] [-best-effort] [-timeout=60] [-retries=3] [-format=png] [-config sources.json] /tiles/source1/ [https://foo.com/tiles/source2/ [...]]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Serves /{z}/{x}/{y}.png (or the extension of -format) by merging all sources in the z-order specified on demand,")
+		fmt.Fprintln(os.Stderr, "without writing anything. A TileJSON description is available at /tile.json.")
+		fmt.Fprintln(os.Stderr, "")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	specs, err := parseSourceSpecs(flags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*configPath) > 0 {
+		configSources, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		specs = append(specs, configSources...)
+	}
+	if len(specs) < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	outFormat, err := NewOutputFormat(*format, *quality, *background)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Discovering tilesets...")
+	sources, errs := discoverTilesets(context.Background(), specs, TilesetDescriptor{MinZ: -1, MaxZ: -1}, *bestEffort, *timeout,
+		&RetryPolicy{Attempts: *retries, Backoff: 500 * time.Millisecond, MaxBackoff: maxRetryBackoff, Jitter: 0.5})
+	if errs != nil && !*bestEffort {
+		log.Fatalf("could not discover tilesets: %v", errs)
+	}
+
+	server := newTileServer(sources, &Merger{BestEffort: *bestEffort, Format: outFormat}, *cacheSize)
+	log.Printf("Serving zoom levels %d-%d on %s", server.minZ, server.maxZ, *listen)
+	log.Fatal(http.ListenAndServe(*listen, server))
+}
+
+// buildIndex indexes the tiles listed on discovery, so that Resolve finds the
+// ancestors of overzoomed tiles.
+func (t *TilesetDescriptor) buildIndex() {
+	t.index = map[[3]int]string{}
+	for _, tiles := range t.Tiles {
+		for _, tile := range tiles {
+			t.index[[3]int{tile.Z, tile.X, tile.Y}] = tile.Format
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v4lli/prioritile/FsBackend"
+)
+
+func TestTileCache(t *testing.T) {
+	cache := newTileCache(2)
+	cache.Add(&cachedTile{key: "1/0/0.png"})
+	cache.Add(&cachedTile{key: "1/0/1.png"})
+	// Touch the first tile, so the second one is evicted next
+	_, ok := cache.Get("1/0/0.png")
+	assert.True(t, ok)
+	cache.Add(&cachedTile{key: "1/1/0.png"})
+
+	_, ok = cache.Get("1/0/1.png")
+	assert.False(t, ok)
+	_, ok = cache.Get("1/0/0.png")
+	assert.True(t, ok)
+	_, ok = cache.Get("1/1/0.png")
+	assert.True(t, ok)
+}
+
+// testServer serves a single red tile 0/0/0.png, overzoomed by one level.
+func testServer(t *testing.T) *tileServer {
+	source := testTileset(t, "red", 256, 256, color.NRGBA{R: 0xff, A: 0xff})
+	options := defaultSourceOptions()
+	options.Overzoom = 1
+	specs := []SourceSpec{{Path: source.Backend.(*FsBackend.FsBackend).BasePath, SourceOptions: options}}
+	sources, errs := discoverTilesets(context.Background(), specs, TilesetDescriptor{MinZ: -1, MaxZ: -1}, false, 60, nil)
+	require.Empty(t, errs)
+	return newTileServer(sources, &Merger{}, 16)
+}
+
+func TestServeTile(t *testing.T) {
+	server := testServer(t)
+
+	// Overzoomed tiles are served as well
+	for _, path := range []string{"/0/0/0.png", "/1/1/1.png"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+		assert.NotEmpty(t, w.Body.Bytes())
+	}
+	for _, path := range []string{"/2/0/0.png", "/1/0/0.jpg", "/foo"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestServeETag(t *testing.T) {
+	server := testServer(t)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/1/0/1.png", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	for match, code := range map[string]int{
+		etag:               http.StatusNotModified,
+		"W/" + etag:        http.StatusNotModified,
+		`"other", ` + etag: http.StatusNotModified,
+		"*":                http.StatusNotModified,
+		`"other"`:          http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/1/0/1.png", nil)
+		r.Header.Set("If-None-Match", match)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, match)
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+		if code == http.StatusNotModified {
+			assert.Empty(t, w.Body.Bytes())
+		}
+	}
+}
+
+func TestServeTileJSON(t *testing.T) {
+	server := testServer(t)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "http://tiles.example.com/tile.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var tileJSON struct {
+		Tiles   []string
+		MinZoom int
+		MaxZoom int
+		Bounds  [4]float64
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tileJSON))
+	assert.Equal(t, []string{"http://tiles.example.com/{z}/{x}/{y}.png"}, tileJSON.Tiles)
+	assert.Equal(t, 0, tileJSON.MinZoom)
+	assert.Equal(t, 1, tileJSON.MaxZoom)
+	assert.InDelta(t, -180, tileJSON.Bounds[0], 1e-9)
+	assert.InDelta(t, 180, tileJSON.Bounds[2], 1e-9)
+}
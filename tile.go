@@ -20,7 +20,13 @@ func (p TileDescriptor) String() string {
 
 func Str2Tile(tileSpec string) (*TileDescriptor, error) {
 	parts := strings.Split(tileSpec, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid tile %s, expected format {z}/{x}/{y}.<ext>", tileSpec)
+	}
 	yParts := strings.Split(parts[2], ".")
+	if len(yParts) != 2 {
+		return nil, fmt.Errorf("invalid tile %s, expected format {z}/{x}/{y}.<ext>", tileSpec)
+	}
 
 	z, err := strconv.Atoi(parts[0])
 	if err != nil {
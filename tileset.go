@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strconv"
@@ -8,10 +9,44 @@ import (
 )
 
 type TilesetDescriptor struct {
+	Name    string // location as specified on the command line
 	MaxZ    int
 	MinZ    int
 	Backend StorageBackend
 	Tiles   map[int][]TileDescriptor // <zoom, []tiles> mapping
+	Options SourceOptions
+
+	index   map[[3]int]string // formats of the known tiles, nil if not listed
+	cutline *Cutline
+}
+
+// Covers reports whether the tileset may contribute to tile, i.e. the tile
+// isn't entirely outside of its cutline.
+func (t *TilesetDescriptor) Covers(tile TileDescriptor) bool {
+	return t.cutline == nil || t.cutline.Intersects(tile.Z, tile.X, tile.Y)
+}
+
+// Resolve returns the tile of the tileset which covers tile: the tile itself
+// or, for overzoomed tilesets, its nearest existing ancestor no more than
+// Options.Overzoom levels up. The format of the result is the one of the file
+// in the tileset, which may differ from the one of tile.
+func (t *TilesetDescriptor) Resolve(tile TileDescriptor) (TileDescriptor, bool) {
+	if t.index == nil {
+		return tile, true
+	}
+	for level := 0; level <= t.Options.Overzoom && level <= tile.Z; level++ {
+		ancestor := TileDescriptor{
+			Z:       tile.Z - level,
+			X:       tile.X >> uint(level),
+			Y:       tile.Y >> uint(level),
+			TileSet: t,
+		}
+		if format, ok := t.index[[3]int{ancestor.Z, ancestor.X, ancestor.Y}]; ok {
+			ancestor.Format = format
+			return ancestor, true
+		}
+	}
+	return TileDescriptor{}, false
 }
 
 func (t TilesetDescriptor) GetTiles() []TileDescriptor {
@@ -38,26 +73,67 @@ func (t TilesetDescriptor) String() string {
 	return fmt.Sprintf("%d-%d", t.MaxZ, t.MinZ)
 }
 
-func discoverTilesets(paths []string, target TilesetDescriptor, bestEffort bool, timeout int) ([]TilesetDescriptor, []error) {
+// openTilesets opens the backends of the sources without listing them.
+func openTilesets(specs []SourceSpec, timeout int, retry *RetryPolicy) ([]TilesetDescriptor, []error) {
 	var tilesets []TilesetDescriptor
 	var errors []error
 
-	for _, path := range paths {
-		backend, err := stringToBackend(path, true, timeout)
+	for _, spec := range specs {
+		path, opts := spec.Path, spec.SourceOptions
+		backend, err := stringToBackend(path, true, timeout, retry)
 		if err != nil {
 			errors = append(errors, err)
 			continue
 		}
+		backend, err = withScheme(backend, opts.Scheme)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%v for %s", err, path))
+			continue
+		}
+		var cutline *Cutline
+		if len(opts.Cutline) > 0 {
+			cutline, err = LoadCutline(opts.Cutline)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		}
+		tilesets = append(tilesets, TilesetDescriptor{
+			Name:    spec.String(),
+			Backend: backend,
+			Options: opts,
+			cutline: cutline,
+		})
+	}
+	return tilesets, errors
+}
 
-		tileset, err := discoverTileset(backend, target.MinZ, target.MaxZ)
+// discoverTilesets opens the sources and lists all of their tiles.
+func discoverTilesets(ctx context.Context, specs []SourceSpec, target TilesetDescriptor, bestEffort bool, timeout int, retry *RetryPolicy) ([]TilesetDescriptor, []error) {
+	opened, errors := openTilesets(specs, timeout, retry)
+	var tilesets []TilesetDescriptor
+	for _, source := range opened {
+		// Overzoomed tilesets also need the ancestors of the target range
+		minZ := target.MinZ
+		if minZ > 0 {
+			minZ -= source.Options.Overzoom
+			if minZ < 0 {
+				minZ = 0
+			}
+		}
+
+		tileset, err := discoverTileset(ctx, source.Backend, minZ, target.MaxZ)
+		tileset.Name = source.Name
+		tileset.Options = source.Options
+		tileset.cutline = source.cutline
 
 		if err != nil {
-			errors = append(errors, fmt.Errorf("could not discover tileset: %v in %s", err, path))
+			errors = append(errors, fmt.Errorf("could not discover tileset: %v in %s", err, source.Name))
 			continue
 		}
 
-		if len(tilesets) > 0 && (target.MaxZ != tileset.MaxZ || target.MinZ != tileset.MinZ) {
-			errors = append(errors, fmt.Errorf("zoom level mismatch for target and source %s", path))
+		if len(tilesets) > 0 && source.Options.Overzoom == 0 && (target.MaxZ != tileset.MaxZ || target.MinZ != tileset.MinZ) {
+			errors = append(errors, fmt.Errorf("zoom level mismatch for target and source %s", source.Name))
 			if !bestEffort {
 				continue
 			}
@@ -67,8 +143,9 @@ func discoverTilesets(paths []string, target TilesetDescriptor, bestEffort bool,
 	return tilesets, errors
 }
 
-func discoverTileset(backend StorageBackend, minZ int, maxZ int) (TilesetDescriptor, error) {
-	files, err := backend.GetFilesRecursive("")
+// discoverTileset lists the tiles of a backend between minZ and maxZ.
+func discoverTileset(ctx context.Context, backend StorageBackend, minZ int, maxZ int) (TilesetDescriptor, error) {
+	files, err := backend.GetFilesRecursive(ctx, "")
 	if err != nil {
 		return TilesetDescriptor{}, err
 	}
@@ -92,6 +169,11 @@ func buildTilesetStructure(files []string, tileset *TilesetDescriptor) error {
 	var tiles []TileDescriptor
 	tileset.Tiles = map[int][]TileDescriptor{}
 	for _, f := range files {
+		if !strings.Contains(f, "/") {
+			// Files in the root directory can't be tiles (e.g. openlayers.html
+			// from gdal2tiles or prioritile's manifest)
+			continue
+		}
 		pathParts := strings.Split(f, "/")
 		if len(pathParts) != 3 {
 			return fmt.Errorf("invalid file path %s, expected format {z}/{x}/{y}.<ext>", f)
@@ -96,3 +96,31 @@ func TestBuildTilesetStructureInvalid(t *testing.T) {
 	err := buildTilesetStructure(files, &tileset)
 	require.Error(t, err)
 }
+
+func TestBuildTilesetStructureIgnoresRootFiles(t *testing.T) {
+	files := []string{
+		".prioritile-manifest.json",
+		"5/15/19.png",
+		"5/16/19.png",
+		"openlayers.html",
+	}
+	tileset := TilesetDescriptor{}
+	err := buildTilesetStructure(files, &tileset)
+	require.NoError(t, err)
+	assert.Len(t, tileset.Tiles[5], 2)
+}
+
+func TestOverzoom(t *testing.T) {
+	tileset := TilesetDescriptor{Options: SourceOptions{Overzoom: 2}}
+	require.NoError(t, buildTilesetStructure([]string{"4/8/5.png", "5/16/10.png"}, &tileset))
+	tileset.buildIndex()
+
+	ancestor, ok := tileset.Resolve(TileDescriptor{Z: 6, X: 35, Y: 23, Format: "png"})
+	require.True(t, ok)
+	assert.Equal(t, 4, ancestor.Z)
+	ancestor, ok = tileset.Resolve(TileDescriptor{Z: 6, X: 33, Y: 21, Format: "png"})
+	require.True(t, ok)
+	assert.Equal(t, 5, ancestor.Z)
+	_, ok = tileset.Resolve(TileDescriptor{Z: 7, X: 70, Y: 46, Format: "png"})
+	assert.False(t, ok)
+}